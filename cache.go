@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Name of the build cache file, stored in the site root.
+const cacheFileName = ".blockcache.json"
+
+// Bump this whenever the renderer changes in a way that affects its output,
+// to invalidate all cached renders.
+const cacheVersion = 9
+
+// A cached markdown render of a single post.
+type renderCacheEntry struct {
+	Key         string
+	Content     string
+	FeedContent string
+	Summary     string
+	SummaryText string
+	HasMore     bool
+	FeedSummary string
+	MathJax     bool
+	BlockCode   bool
+	MathErrors  []string            // formulas that fell back to MathJax
+	Assets      map[string]assetRef // uri -> referenced file
+}
+
+// A static file referenced by a rendered post.
+type assetRef struct {
+	Src   string // source path
+	Stamp string // fileStampKey of the source at render time
+}
+
+// The build cache remembers the results of the previous build so we only
+// need to re-render posts whose inputs changed, and only rewrite output
+// files whose contents changed.
+type buildCache struct {
+	Version int
+	Renders map[PostID]*renderCacheEntry
+	Outputs map[string]string // output path (relative to OutDir) -> content key
+
+	// State for the build in progress; becomes the new cache when saved.
+	mu         sync.Mutex // guards newRenders and newOutputs
+	newRenders map[PostID]*renderCacheEntry
+	newOutputs map[string]string
+}
+
+func newBuildCache() *buildCache {
+	return &buildCache{
+		Version:    cacheVersion,
+		Renders:    make(map[PostID]*renderCacheEntry),
+		Outputs:    make(map[string]string),
+		newRenders: make(map[PostID]*renderCacheEntry),
+		newOutputs: make(map[string]string),
+	}
+}
+
+// Reads the build cache. A missing or unreadable cache just means we do a
+// full build.
+func loadBuildCache(path string) *buildCache {
+	cache := newBuildCache()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Warnf("couldn't read build cache: %s", err.Error())
+		}
+		return cache
+	}
+
+	old := newBuildCache()
+	if err := json.Unmarshal(data, old); err != nil {
+		Warnf("%s: build cache corrupted, ignoring it: %s", path, err.Error())
+		return cache
+	}
+	if old.Version != cacheVersion {
+		return cache
+	}
+
+	cache.Renders = old.Renders
+	cache.Outputs = old.Outputs
+	return cache
+}
+
+// Writes the state of the current build as the new cache.
+func (cache *buildCache) save(path string) error {
+	data, err := json.Marshal(&buildCache{
+		Version: cacheVersion,
+		Renders: cache.newRenders,
+		Outputs: cache.newOutputs,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func hashBytes(data ...[]byte) string {
+	h := sha1.New()
+	for _, d := range data {
+		// Length prefix so different splits of the same bytes hash differently.
+		fmt.Fprintf(h, "%d:", len(d))
+		h.Write(d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns a string that changes whenever the file at path changes.
+func fileStampKey(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// Hash of everything about the other posts that can affect a render: post
+// links pick up their targets' titles and names (and can't point to
+// unpublished posts), and images are searched in the asset directories of
+// parent posts.
+func (blog *Blog) linkContextKey() []byte {
+	posts := make([]*Post, len(blog.AllPosts))
+	copy(posts, blog.AllPosts)
+	sort.Sort(postsById(posts))
+
+	var buf bytes.Buffer
+	for _, post := range posts {
+		fmt.Fprintf(&buf, "%q %q %q %q %q %q %v\n", post.Id, post.Title, post.RenderedName(), post.AssetPath(), post.assetDir, post.parentId, post.unpublished)
+	}
+	return buf.Bytes()
+}
+
+// Key for the render of a post; if it's unchanged, so is the render (as
+// long as the referenced assets are unchanged too). config is the site
+// configuration, which template shortcodes see all of as .Blog. Shortcodes can use any
+// of the post's properties, so the whole header is part of it. Standalone
+// pages don't get a feed render, so the post type is too.
+func (post *Post) renderKey(blog *Blog, config, linkContext []byte) string {
+	return hashBytes(
+		[]byte(fmt.Sprintf("v%d %d", cacheVersion, post.Type)),
+		config,
+		linkContext,
+		[]byte(blog.shortcodeKey),
+		[]byte(post.Id),
+		post.header,
+		post.markdown)
+}
+
+// Restores a post's render from the cache, if it's still valid.
+func (cache *buildCache) restoreRender(blog *Blog, post *Post, key string) bool {
+	entry := cache.Renders[post.Id]
+	if entry == nil || entry.Key != key {
+		return false
+	}
+
+	for _, asset := range entry.Assets {
+		if stamp, err := fileStampKey(asset.Src); err != nil || stamp != asset.Stamp {
+			return false
+		}
+	}
+
+	post.assets = make(map[string]string)
+	for uri, asset := range entry.Assets {
+		if err := blog.AddStaticFile(uri, asset.Src); err != nil {
+			return false
+		}
+		post.assets[uri] = asset.Src
+	}
+
+	post.Content = template.HTML(entry.Content)
+	post.FeedContent = template.HTML(entry.FeedContent)
+	post.Summary = template.HTML(entry.Summary)
+	post.SummaryText = entry.SummaryText
+	post.HasMore = entry.HasMore
+	post.feedSummary = template.HTML(entry.FeedSummary)
+	post.MathJax = entry.MathJax
+	post.BlockCode = entry.BlockCode
+	post.mathErrors = entry.MathErrors
+
+	cache.mu.Lock()
+	cache.newRenders[post.Id] = entry
+	cache.mu.Unlock()
+	return true
+}
+
+// Remembers a successful render of a post.
+func (cache *buildCache) storeRender(post *Post, key string) {
+	entry := &renderCacheEntry{
+		Key:         key,
+		Content:     string(post.Content),
+		FeedContent: string(post.FeedContent),
+		Summary:     string(post.Summary),
+		SummaryText: post.SummaryText,
+		HasMore:     post.HasMore,
+		FeedSummary: string(post.feedSummary),
+		MathJax:     post.MathJax,
+		BlockCode:   post.BlockCode,
+		MathErrors:  post.mathErrors,
+		Assets:      make(map[string]assetRef),
+	}
+	for uri, src := range post.assets {
+		stamp, err := fileStampKey(src)
+		if err != nil {
+			// Don't cache renders we can't validate later.
+			return
+		}
+		entry.Assets[uri] = assetRef{src, stamp}
+	}
+
+	cache.mu.Lock()
+	cache.newRenders[post.Id] = entry
+	cache.mu.Unlock()
+}
+
+// Records that the current build produces output file dst with the given
+// content key. Returns true if the file on disk is already up to date.
+func (cache *buildCache) output(blog *Blog, dst, key string) bool {
+	cache.mu.Lock()
+	cache.newOutputs[dst] = key
+	cache.mu.Unlock()
+
+	if cache.Outputs[dst] != key {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(blog.OutDir, filepath.FromSlash(dst)))
+	return err == nil
+}
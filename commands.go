@@ -0,0 +1,254 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type command struct {
+	name  string
+	args  string // argument synopsis for usage
+	short string // one-line description
+	run   func(blog *Blog, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	// Initialized here rather than in the declaration since the commands
+	// look themselves up in the table, which would be an initialization loop.
+	commands = []*command{
+		{"build", "[-clean] [-drafts] [-future]", "render the site into the output directory", runBuild},
+		{"check", "[-drafts] [-future]", "read and render all posts without writing any output", runCheck},
+		{"serve", "[-addr host:port] [-drafts] [-future]", "serve the site over HTTP, rebuilding and reloading on changes", runServe},
+		{"new", "[-title t] [-type t] [-parent id] [-draft] <id>", "create a new post file", runNew},
+		{"import", "<format> [arguments]", "import posts from another blog engine", runImport},
+		{"list", "", "list all posts with their type, dates and parents", runList},
+		{"rollback", "", "restore the output directory of the previous build", runRollback},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-site dir] <command> [arguments]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprint(os.Stderr, "Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprint(os.Stderr, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// Returns a flag set for the given command that prints a sensible usage
+// message.
+func newFlagSet(cmd *command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", filepath.Base(os.Args[0]), cmd.name, cmd.args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Adds the flags that control which posts get published.
+func addPublishFlags(flags *flag.FlagSet, blog *Blog) {
+	flags.BoolVar(&blog.IncludeDrafts, "drafts", false, "include posts marked as drafts")
+	flags.BoolVar(&blog.IncludeFuture, "future", false, "include posts dated in the future")
+}
+
+// Reads, links and renders all posts, but doesn't write anything.
+func (blog *Blog) Load() error {
+	if err := blog.AddStaticFiles(); err != nil {
+		return err
+	}
+	if err := blog.LoadShortcodes(); err != nil {
+		return err
+	}
+	if err := blog.ReadPosts(); err != nil {
+		return err
+	}
+	if err := blog.LinkPosts(); err != nil {
+		return err
+	}
+	if err := blog.GenerateArchive(); err != nil {
+		return err
+	}
+	if err := blog.GenerateCollections(); err != nil {
+		return err
+	}
+	if err := blog.GenerateTagPages(); err != nil {
+		return err
+	}
+	if err := blog.AssignPermalinks(); err != nil {
+		return err
+	}
+	if err := blog.RenderPosts(); err != nil {
+		return err
+	}
+	return blog.checkRedirectAssets()
+}
+
+func runBuild(blog *Blog, args []string) error {
+	flags := newFlagSet(findCommand("build"))
+	clean := flags.Bool("clean", false, "ignore the build cache and rebuild everything from scratch")
+	addPublishFlags(flags, blog)
+	flags.Parse(args)
+
+	if *clean {
+		if err := os.Remove(cacheFileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := blog.Load(); err != nil {
+		return err
+	}
+	if err := blog.WriteOutput(); err != nil {
+		return err
+	}
+
+	fmt.Println("Done!")
+	return nil
+}
+
+func runCheck(blog *Blog, args []string) error {
+	flags := newFlagSet(findCommand("check"))
+	addPublishFlags(flags, blog)
+	flags.Parse(args)
+
+	if err := blog.Load(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d posts OK, %d unpublished.\n", len(blog.AllPosts)-len(blog.Unpublished), len(blog.Unpublished))
+	return nil
+}
+
+func runNew(blog *Blog, args []string) error {
+	cmd := findCommand("new")
+	flags := newFlagSet(cmd)
+	title := flags.String("title", "", "title of the new post (defaults to the ID)")
+	typ := flags.String("type", "post", "document type (post or page)")
+	parent := flags.String("parent", "", "ID of the parent post, for series")
+	draft := flags.Bool("draft", false, "mark the new post as a draft")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	id := flags.Arg(0)
+	if strings.ContainsAny(id, "/\\.") {
+		return fmt.Errorf("%q: post IDs can't contain slashes or dots.", id)
+	}
+	if t, ok := docType[*typ]; !ok || t == DocCollection {
+		return fmt.Errorf("%q: can't create posts of type %q.", id, *typ)
+	}
+	existing, err := blog.postFileFor(PostID(id))
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return fmt.Errorf("%q: post file %q already exists.", id, existing)
+	}
+	if *parent != "" {
+		// Parent has to exist; reading the posts is enough to check.
+		if err := blog.ReadPosts(); err != nil {
+			return err
+		}
+		if blog.FindPostById(PostID(*parent)) == nil {
+			return fmt.Errorf("%q: parent id %q does not correspond to an existing post.", id, *parent)
+		}
+	}
+	if *title == "" {
+		*title = id
+	}
+
+	// Write the header
+	header := fmt.Sprintf("-title=%s\n", *title)
+	if *typ != "post" {
+		header += fmt.Sprintf("-type=%s\n", *typ)
+	}
+	// With the offset, so the time means the same wherever the site is built.
+	header += fmt.Sprintf("-time=%s\n", time.Now().Format("2006-01-02 15:04:05 -07:00"))
+	if *parent != "" {
+		header += fmt.Sprintf("-parent=%s\n", *parent)
+	}
+	if *draft {
+		header += "-draft=true\n"
+	}
+	header += "\n"
+
+	path, err := createPostFile(blog, id, []byte(header))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %q\n", path)
+	return nil
+}
+
+func runList(blog *Blog, args []string) error {
+	newFlagSet(findCommand("list")).Parse(args)
+
+	// List everything, with drafts and scheduled posts marked as such.
+	blog.IncludeDrafts = true
+	blog.IncludeFuture = true
+
+	if err := blog.ReadPosts(); err != nil {
+		return err
+	}
+	if err := blog.LinkPosts(); err != nil {
+		return err
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	now := time.Now()
+	fmt.Fprintln(w, "ID\tTYPE\tSTATUS\tPUBLISHED\tUPDATED\tPARENT\tTITLE")
+	for _, post := range blog.AllPosts {
+		status := "-"
+		if post.Draft {
+			status = "draft"
+		} else if !post.Standalone() && post.Published.After(now) {
+			status = "scheduled"
+		}
+
+		parent := "-"
+		if post.parentId != "" {
+			parent = string(post.parentId)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", post.Id, post.Type, status, formatTime(post.Published), formatTime(post.Updated), parent, post.Title)
+	}
+	return w.Flush()
+}
+
+func runRollback(blog *Blog, args []string) error {
+	newFlagSet(findCommand("rollback")).Parse(args)
+
+	if err := blog.RollbackOutput(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored previous build of %q.\n", blog.OutDir)
+	return nil
+}
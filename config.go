@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the site config file, looked for in the site root.
+const configFileName = "blog.json"
+
+// Returns a blog with all configuration options set to their defaults.
+func NewBlog() *Blog {
+	return &Blog{
+		AtomFeedFile:   "feed.atom.xml",
+		NumRecentPosts: 5,
+		NumFeedPosts:   10,
+		NumIndexPosts:  10,
+		SummaryWords:   70,
+		NumRssPosts:    10,
+		NumJsonPosts:   10,
+		MaxImageWidth:  700,
+		ImageCacheDir:  ".imagecache",
+		Highlight:      "client",
+		Math:           "mathjax",
+		PostDir:        "posts",
+		TemplateDir:    "template",
+		OutDir:         "out",
+		Permalink:      defaultPermalink,
+		PagePermalink:  defaultPermalink,
+	}
+}
+
+// Finds the config file for the site rooted at dir.
+func findConfig(dir string) (string, error) {
+	path := filepath.Join(dir, configFileName)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%q: no %s found in site root.", dir, configFileName)
+		}
+		return "", err
+	}
+	return path, nil
+}
+
+// Reads the site configuration from the given file. Options not present in
+// the file keep their current values.
+func (blog *Blog) LoadConfig(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(blog); err != nil {
+		switch e := err.(type) {
+		case *json.UnmarshalTypeError:
+			return fmt.Errorf("%s: key %q: expected %s, got %s.", path, e.Field, e.Type, e.Value)
+		case *json.SyntaxError:
+			return fmt.Errorf("%s: syntax error at offset %d: %s", path, e.Offset, err.Error())
+		}
+
+		if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+			return fmt.Errorf("%s: unknown key %s.", path, strings.TrimPrefix(msg, "json: unknown field "))
+		}
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if err := blog.validateConfig(); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// Checks that the configuration options are sane.
+func (blog *Blog) validateConfig() error {
+	required := []struct {
+		key   string
+		value string
+	}{
+		{"title", blog.Title},
+		{"url", blog.Url},
+		{"atom_feed_file", blog.AtomFeedFile},
+		{"post_dir", blog.PostDir},
+		{"template_dir", blog.TemplateDir},
+		{"out_dir", blog.OutDir},
+		{"image_cache_dir", blog.ImageCacheDir},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("key %q must be set.", r.key)
+		}
+	}
+
+	// The staging and backup directories are siblings of OutDir, so it
+	// can't have a trailing slash or be the site directory itself.
+	blog.OutDir = filepath.Clean(blog.OutDir)
+	if blog.OutDir == "." || blog.OutDir == filepath.Dir(blog.OutDir) {
+		return fmt.Errorf("key %q must name a directory of its own, got %q.", "out_dir", blog.OutDir)
+	}
+
+	positive := []struct {
+		key   string
+		value int
+	}{
+		{"num_recent_posts", blog.NumRecentPosts},
+		{"num_feed_posts", blog.NumFeedPosts},
+		{"num_index_posts", blog.NumIndexPosts},
+		{"summary_words", blog.SummaryWords},
+		{"num_rss_posts", blog.NumRssPosts},
+		{"num_json_posts", blog.NumJsonPosts},
+		{"max_image_width", blog.MaxImageWidth},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return fmt.Errorf("key %q must be positive, got %d.", p.key, p.value)
+		}
+	}
+
+	for _, w := range blog.ImageWidths {
+		if w <= 0 {
+			return fmt.Errorf("key %q must only contain positive widths, got %d.", "image_widths", w)
+		}
+	}
+
+	if blog.Highlight != "server" && blog.Highlight != "client" {
+		return fmt.Errorf("key %q must be \"server\" or \"client\", got %q.", "highlight", blog.Highlight)
+	}
+
+	if blog.Math != "mathml" && blog.Math != "mathjax" {
+		return fmt.Errorf("key %q must be \"mathml\" or \"mathjax\", got %q.", "math", blog.Math)
+	}
+
+	if err := validatePermalink("permalink", blog.Permalink); err != nil {
+		return err
+	}
+	if err := validatePermalink("page_permalink", blog.PagePermalink); err != nil {
+		return err
+	}
+
+	for _, name := range blog.RedirectMaps {
+		if _, ok := redirectMaps[name]; !ok {
+			return fmt.Errorf("key %q: unknown redirect map format %q.", "redirect_maps", name)
+		}
+	}
+
+	if blog.Workers < 0 {
+		return fmt.Errorf("key %q can't be negative, got %d.", "workers", blog.Workers)
+	}
+
+	if err := blog.validateParamSchema(); err != nil {
+		return err
+	}
+
+	// All generated URLs are of the form blog.Url + "/" + path.
+	blog.Url = strings.TrimRight(blog.Url, "/")
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Feed readers show entries out of context: without our stylesheet or
+// scripts, and often without knowing where the page lives. So posts get
+// rendered a second time for feeds, with absolute URLs, math as MathML
+// (or its TeX source if we can't convert it) and inline image sizes.
+
+// Attributes containing URLs in rendered HTML.
+var urlAttr = regexp.MustCompile(`(?i)(\s(?:href|src|poster|srcset)\s*=\s*)("[^"]*"|'[^']*')`)
+
+// Makes all URLs in the attributes of html absolute, relative to base.
+func absolutizeUrls(htmlText []byte, base *url.URL) []byte {
+	return urlAttr.ReplaceAllFunc(htmlText, func(m []byte) []byte {
+		sub := urlAttr.FindSubmatch(m)
+		attr, quoted := sub[1], sub[2]
+		quote, value := quoted[0], html.UnescapeString(string(quoted[1:len(quoted)-1]))
+
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(string(attr))), "srcset") {
+			// Comma-separated list of "url width" pairs
+			candidates := strings.Split(value, ",")
+			for i, c := range candidates {
+				fields := strings.Fields(c)
+				if len(fields) > 0 {
+					fields[0] = absoluteUrl(fields[0], base)
+				}
+				candidates[i] = strings.Join(fields, " ")
+			}
+			value = strings.Join(candidates, ", ")
+		} else {
+			value = absoluteUrl(value, base)
+		}
+
+		var buf bytes.Buffer
+		buf.Write(attr)
+		buf.WriteByte(quote)
+		buf.WriteString(html.EscapeString(value))
+		buf.WriteByte(quote)
+		return buf.Bytes()
+	})
+}
+
+func absoluteUrl(ref string, base *url.URL) string {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// URL of a post's page.
+func (blog *Blog) postUrl(post *Post) string {
+	return blog.Url + "/" + post.urlPath
+}
+
+// Renders the version of a post's content that goes into feeds. Needs the
+// regular render first, since it reuses its image variants.
+func (post *Post) RenderFeed(blog *Blog) error {
+	base, err := url.Parse(blog.postUrl(post))
+	if err != nil {
+		return err
+	}
+
+	renderer := newHtmlRenderer(post, blog)
+	renderer.feed = true
+	content, err := renderer.render(post.markdown)
+	if err != nil {
+		return err
+	}
+	post.FeedContent = template.HTML(absolutizeUrls(content, base))
+
+	summary, _, err := post.renderSummary(blog, content, true)
+	if err != nil {
+		return err
+	}
+	post.feedSummary = template.HTML(absolutizeUrls(summary, base))
+	return nil
+}
+
+// Everything the feed formats need to know about a feed.
+type feedInfo struct {
+	Title       string
+	Id          string
+	Alternate   string // URL of the corresponding page
+	Description string
+
+	posts []*Post // most recent first
+}
+
+// A feed entry, shared by all feed formats.
+type feedEntry struct {
+	Id        string
+	Title     string
+	Url       string
+	Published time.Time
+	Updated   time.Time
+	Content   string
+	Summary   string // plain text
+	Tags      []string
+}
+
+// Returns entries for the first n posts, plus the time the most recent
+// of them was updated.
+func (blog *Blog) feedEntries(posts []*Post, n int) (entries []feedEntry, updated time.Time) {
+	for i, post := range posts {
+		if i >= n {
+			break
+		}
+		if post.Updated.After(updated) {
+			updated = post.Updated
+		}
+		entry := feedEntry{
+			Id:        blog.atomIdBase() + string(post.Id), // stays put when permalinks change
+			Title:     post.Title,
+			Url:       blog.postUrl(post),
+			Published: post.Published,
+			Updated:   post.Updated,
+			Content:   string(post.FeedContent),
+			Summary:   post.SummaryText,
+			Tags:      post.Tags,
+		}
+		if blog.FeedSummaries && post.HasMore {
+			entry.Content = fmt.Sprintf("%s\n<p><a href=\"%s\">Read more…</a></p>", post.feedSummary, html.EscapeString(entry.Url))
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// A feed for autodiscovery links.
+type FeedLink struct {
+	Title string
+	Type  string // MIME type
+	Href  string
+}
+
+func (blog *Blog) addFeedLink(mimeType, file string) {
+	blog.Feeds = append(blog.Feeds, &FeedLink{blog.Title, mimeType, blog.Url + "/" + file})
+}
+
+// Autodiscovery <link> tags for all site-wide feeds, for use in the
+// template's <head>.
+func (blog *Blog) FeedLinks() template.HTML {
+	var buf bytes.Buffer
+	for _, feed := range blog.Feeds {
+		fmt.Fprintf(&buf, "<link rel=\"alternate\" type=\"%s\" title=\"%s\" href=\"%s\">\n",
+			feed.Type, html.EscapeString(feed.Title), html.EscapeString(feed.Href))
+	}
+	return template.HTML(buf.String())
+}
+
+// RSS 2.0
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          rssLink   `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Guid        rssGuid  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Id          string `xml:",chardata"`
+}
+
+// Renders an RSS 2.0 feed with the first n entries of feed.
+func (blog *Blog) rssFeedFor(feed *feedInfo, feedFile string, n int) ([]byte, error) {
+	out := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       feed.Title,
+			Link:        feed.Alternate,
+			Description: feed.Description,
+			Self:        rssLink{blog.Url + "/" + feedFile, "self", "application/rss+xml"},
+		},
+	}
+	if out.Channel.Description == "" {
+		// Required by the spec
+		out.Channel.Description = feed.Title
+	}
+
+	entries, updated := blog.feedEntries(feed.posts, n)
+	if !updated.IsZero() {
+		out.Channel.LastBuildDate = updated.Format(time.RFC1123Z)
+	}
+	for _, entry := range entries {
+		out.Channel.Items = append(out.Channel.Items, rssItem{
+			Title:       entry.Title,
+			Link:        entry.Url,
+			Guid:        rssGuid{false, entry.Id},
+			PubDate:     entry.Published.Format(time.RFC1123Z),
+			Categories:  entry.Tags,
+			Description: entry.Content,
+		})
+	}
+
+	data, err := xml.Marshal(&out)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// JSON Feed 1.1
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	FeedUrl     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Authors     []jsonAuthor   `json:"authors,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	Id            string   `json:"id"`
+	Url           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHtml   string   `json:"content_html"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+// Renders a JSON Feed with the first n entries of feed.
+func (blog *Blog) jsonFeedFor(feed *feedInfo, feedFile string, n int) ([]byte, error) {
+	out := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feed.Title,
+		HomePageUrl: feed.Alternate,
+		FeedUrl:     blog.Url + "/" + feedFile,
+		Description: feed.Description,
+		Items:       []jsonFeedItem{},
+	}
+	if blog.Author != "" {
+		out.Authors = []jsonAuthor{{blog.Author}}
+	}
+
+	entries, _ := blog.feedEntries(feed.posts, n)
+	for _, entry := range entries {
+		out.Items = append(out.Items, jsonFeedItem{
+			Id:            entry.Id,
+			Url:           entry.Url,
+			Title:         entry.Title,
+			ContentHtml:   entry.Content,
+			Summary:       entry.Summary,
+			DatePublished: entry.Published.Format(time.RFC3339),
+			DateModified:  entry.Updated.Format(time.RFC3339),
+			Tags:          entry.Tags,
+		})
+	}
+	return json.MarshalIndent(&out, "", "  ")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Structured front matter is delimited by a line consisting of "---" (YAML)
+// or "+++" (TOML) at the start of the file, and a matching line after it.
+var frontMatterFormats = []struct {
+	delim  string
+	name   string
+	decode func(data []byte, out *map[string]interface{}) error
+}{
+	{"---", "YAML", func(data []byte, out *map[string]interface{}) error {
+		return yaml.Unmarshal(data, out)
+	}},
+	{"+++", "TOML", func(data []byte, out *map[string]interface{}) error {
+		return toml.Unmarshal(data, out)
+	}},
+}
+
+// Splits the first line off text, stripping the line terminator.
+func splitLine(text []byte) (line, rest []byte) {
+	eol := bytes.IndexByte(text, '\n')
+	if eol == -1 {
+		return text, text[len(text):]
+	}
+	line, rest = text[:eol], text[eol+1:]
+
+	// if this line was terminated by CRLF, strip the CR too
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return
+}
+
+// Parses structured front matter at the start of contents, if there is any.
+// Returns the properties and the remaining text; props is nil if there is
+// no front matter.
+func parseFrontMatter(contents []byte) (props map[string]interface{}, rest []byte, err error) {
+	first, body := splitLine(contents)
+	for _, format := range frontMatterFormats {
+		if string(first) != format.delim {
+			continue
+		}
+
+		// Find the closing delimiter
+		start := body
+		for len(body) > 0 {
+			var line []byte
+			end := len(start) - len(body)
+			line, body = splitLine(body)
+			if string(line) == format.delim {
+				props = make(map[string]interface{})
+				if err = format.decode(start[:end], &props); err != nil {
+					return nil, nil, fmt.Errorf("%s front matter: %s", format.name, err.Error())
+				}
+				return props, body, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("%s front matter not terminated by %q.", format.name, format.delim)
+	}
+	return nil, contents, nil
+}
+
+// Returns the keys of a property map in sorted order, so properties are
+// applied (and errors reported) deterministically.
+func sortedKeys(props map[string]interface{}) []string {
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Converts a front matter value for a property that takes a single string.
+func propertyString(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05"), nil
+	}
+	return "", fmt.Errorf("property %q needs a single value, not %T", key, value)
+}
+
+// Converts a front matter value for a property that takes a list of strings.
+// In the dash syntax, lists are comma-separated. Duplicates are dropped.
+func propertyStringList(key string, value interface{}) ([]string, error) {
+	items, err := paramList(value)
+	if err != nil {
+		return nil, fmt.Errorf("property %q: %s", key, err.Error())
+	}
+
+	var list []string
+	seen := make(map[string]bool)
+	for _, item := range items.([]interface{}) {
+		str, err := propertyString(key, item)
+		if err != nil {
+			return nil, err
+		}
+		if str = strings.TrimSpace(str); str != "" && !seen[str] {
+			seen[str] = true
+			list = append(list, str)
+		}
+	}
+	return list, nil
+}
+
+// Converts a front matter value for a property that takes a time.
+func propertyTime(key string, value interface{}) (time.Time, error) {
+	if t, ok := value.(time.Time); ok {
+		// Times from the dash syntax are in UTC, so keep these consistent.
+		// (TOML local times come with a zero offset, so they keep their
+		// wall clock time.)
+		return t.UTC(), nil
+	}
+
+	str, err := propertyString(key, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseTime(str)
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// Build-time syntax highlighting for fenced code blocks. The output uses
+// the same "token <kind>" span classes as Prism, so the same stylesheets
+// work for both server- and client-side highlighting.
+
+type language struct {
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string // string delimiters (with backslash escapes)
+	rawQuotes     string // string delimiters without escapes
+	tripleQuotes  bool   // """ and ''' strings
+	preprocessor  bool   // "#" at the start of a line starts a directive
+	decorators    bool   // "@name" is a decorator
+	asm           bool   // first word on a line is an instruction
+	ignoreCase    bool   // keywords and registers are case insensitive
+	identChars    string // extra characters allowed in identifiers
+
+	keywords  map[string]bool
+	builtins  map[string]bool // built-in types and functions
+	registers map[string]bool
+}
+
+func wordSet(lists ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, word := range strings.Fields(list) {
+			set[word] = true
+		}
+	}
+	return set
+}
+
+// Vector and matrix types for shading languages: base1..base4 and
+// base1x1..base4x4.
+func shaderVectorTypes(bases ...string) string {
+	var buf bytes.Buffer
+	for _, base := range bases {
+		for n := 1; n <= 4; n++ {
+			fmt.Fprintf(&buf, "%s%d ", base, n)
+			for m := 1; m <= 4; m++ {
+				fmt.Fprintf(&buf, "%s%dx%d ", base, n, m)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// Numbered register names: for each prefix, prefix0..prefix(n-1).
+func numberedRegisters(n int, prefixes ...string) string {
+	var buf bytes.Buffer
+	for _, prefix := range prefixes {
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&buf, "%s%d ", prefix, i)
+		}
+	}
+	return buf.String()
+}
+
+const (
+	cKeywords = `auto break case char const continue default do double else enum
+		extern float for goto if inline int long register restrict return short
+		signed sizeof static struct switch typedef union unsigned void volatile
+		while _Bool _Alignas _Alignof _Atomic _Noreturn _Static_assert _Thread_local`
+	cBuiltins = `size_t ptrdiff_t intptr_t uintptr_t int8_t int16_t int32_t int64_t
+		uint8_t uint16_t uint32_t uint64_t FILE NULL`
+	cppKeywords = `alignas alignof and bool catch class const_cast constexpr consteval
+		constinit decltype delete dynamic_cast explicit export false final friend
+		mutable namespace new noexcept not nullptr operator or override private
+		protected public reinterpret_cast static_assert static_cast template this
+		thread_local throw true try typeid typename using virtual wchar_t xor`
+	cppBuiltins = `std string vector map unordered_map set unique_ptr shared_ptr
+		nullptr_t`
+	goKeywords = `break case chan const continue default defer else fallthrough for
+		func go goto if import interface map package range return select struct
+		switch type var`
+	goBuiltins = `any bool byte comparable complex64 complex128 error float32 float64
+		int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64
+		uintptr true false iota nil append cap clear close complex copy delete
+		imag len make max min new panic print println real recover`
+	pythonKeywords = `False None True and as assert async await break class continue
+		def del elif else except finally for from global if import in is lambda
+		nonlocal not or pass raise return try while with yield`
+	pythonBuiltins = `abs all any bool bytes dict enumerate filter float int isinstance
+		len list map max min object open print range repr reversed round self set
+		sorted str sum super tuple type zip`
+	hlslKeywords = `break case cbuffer centroid column_major const continue default
+		discard do else false for groupshared if in inline inout linear
+		nointerpolation noperspective out packoffset pass precise register return
+		row_major sample static struct switch tbuffer technique true typedef
+		uniform void while`
+	hlslBuiltins = `bool int uint dword half float double Buffer ByteAddressBuffer
+		RWByteAddressBuffer StructuredBuffer RWStructuredBuffer
+		AppendStructuredBuffer ConsumeStructuredBuffer Texture1D Texture1DArray
+		Texture2D Texture2DArray Texture2DMS Texture3D TextureCube
+		TextureCubeArray RWTexture1D RWTexture2D RWTexture2DArray RWTexture3D
+		SamplerState SamplerComparisonState`
+	glslKeywords = `attribute break buffer case centroid coherent const continue
+		default discard do else false flat for highp if in inout invariant
+		layout lowp mediump noperspective out patch precise precision readonly
+		restrict return sample shared smooth struct subroutine switch true
+		uniform varying void volatile while writeonly`
+	glslBuiltins = `bool int uint float double sampler1D sampler2D sampler3D
+		samplerCube sampler2DShadow samplerCubeShadow sampler2DArray
+		sampler2DArrayShadow isampler2D usampler2D image1D image2D image3D
+		imageCube iimage2D uimage2D`
+	x86Registers = `rax rbx rcx rdx rsi rdi rbp rsp rip eax ebx ecx edx esi edi ebp
+		esp eip ax bx cx dx si di bp sp al bl cl dl ah bh ch dh sil dil bpl spl
+		cs ds es fs gs ss`
+	armRegisters = `sp lr pc fp ip xzr wzr apsr cpsr spsr fpscr nzcv`
+)
+
+var languages = map[string]*language{}
+
+func init() {
+	cLike := func(keywords, builtins string) *language {
+		return &language{
+			lineComments:  []string{"//"},
+			blockComments: [][2]string{{"/*", "*/"}},
+			quotes:        `"'`,
+			preprocessor:  true,
+			keywords:      wordSet(keywords),
+			builtins:      wordSet(builtins),
+		}
+	}
+
+	c := cLike(cKeywords, cBuiltins)
+	cpp := cLike(cKeywords+" "+cppKeywords, cBuiltins+" "+cppBuiltins)
+	hlsl := cLike(hlslKeywords, hlslBuiltins+" "+
+		shaderVectorTypes("bool", "int", "uint", "half", "float", "double", "min16float", "min16int", "min16uint"))
+	glsl := cLike(glslKeywords, glslBuiltins+" "+
+		shaderVectorTypes("vec", "dvec", "bvec", "ivec", "uvec", "mat", "dmat"))
+
+	golang := &language{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+		rawQuotes:     "`",
+		keywords:      wordSet(goKeywords),
+		builtins:      wordSet(goBuiltins),
+	}
+
+	python := &language{
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		tripleQuotes: true,
+		decorators:   true,
+		keywords:     wordSet(pythonKeywords),
+		builtins:     wordSet(pythonBuiltins),
+	}
+
+	x86 := &language{
+		lineComments: []string{";", "#"},
+		quotes:       `"'`,
+		asm:          true,
+		ignoreCase:   true,
+		identChars:   ".%@?",
+		keywords:     wordSet("byte word dword qword xmmword ymmword zmmword ptr offset rel"),
+		registers: wordSet(x86Registers,
+			numberedRegisters(32, "xmm", "ymm", "zmm"),
+			numberedRegisters(8, "mm", "st", "k", "cr", "dr"),
+			"r8 r9 r10 r11 r12 r13 r14 r15",
+			"r8d r9d r10d r11d r12d r13d r14d r15d",
+			"r8w r9w r10w r11w r12w r13w r14w r15w",
+			"r8b r9b r10b r11b r12b r13b r14b r15b"),
+	}
+
+	arm := &language{
+		lineComments:  []string{"//", "@", ";"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+		asm:           true,
+		ignoreCase:    true,
+		identChars:    ".$",
+		registers: wordSet(armRegisters,
+			numberedRegisters(16, "r"),
+			numberedRegisters(32, "x", "w", "v", "q", "d", "s", "h", "b", "z", "p")),
+	}
+
+	register := func(lang *language, names ...string) {
+		for _, name := range names {
+			languages[name] = lang
+		}
+	}
+	register(c, "c", "h")
+	register(cpp, "cpp", "c++", "cxx", "cc", "hpp")
+	register(golang, "go", "golang")
+	register(python, "python", "py")
+	register(hlsl, "hlsl")
+	register(glsl, "glsl")
+	register(x86, "x86asm", "x86", "nasm", "asm")
+	register(arm, "arm", "armasm", "aarch64", "arm64")
+}
+
+type codeToken struct {
+	kind string // Prism token kind, empty for plain text
+	text string
+}
+
+type codeLexer struct {
+	lang        *language
+	text        string
+	pos         int
+	lineStart   bool // only whitespace since the start of the line?
+	sawMnemonic bool // asm: already had the instruction on this line?
+	tokens      []codeToken
+}
+
+func (lx *codeLexer) emit(kind string, end int) {
+	text := lx.text[lx.pos:end]
+	lx.pos = end
+
+	// Merge runs of the same kind to keep the output small.
+	if n := len(lx.tokens); n > 0 && lx.tokens[n-1].kind == kind {
+		lx.tokens[n-1].text += text
+	} else {
+		lx.tokens = append(lx.tokens, codeToken{kind, text})
+	}
+}
+
+// Position of the next newline at or after pos (or the end of the text).
+func (lx *codeLexer) endOfLine(pos int) int {
+	if idx := strings.IndexByte(lx.text[pos:], '\n'); idx != -1 {
+		return pos + idx
+	}
+	return len(lx.text)
+}
+
+func (lx *codeLexer) isIdentStart(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || strings.IndexByte(lx.lang.identChars, ch) != -1
+}
+
+func (lx *codeLexer) isIdentChar(ch byte) bool {
+	return lx.isIdentStart(ch) || ch >= '0' && ch <= '9'
+}
+
+// Scans a string starting with the quote at pos, returns its end.
+func (lx *codeLexer) scanString(pos int) int {
+	text := lx.text
+	quote := text[pos]
+
+	if lx.lang.tripleQuotes && strings.HasPrefix(text[pos:], strings.Repeat(string(quote), 3)) {
+		delim := text[pos : pos+3]
+		if end := strings.Index(text[pos+3:], delim); end != -1 {
+			return pos + 3 + end + 3
+		}
+		return len(text)
+	}
+
+	escapes := strings.IndexByte(lx.lang.rawQuotes, quote) == -1
+	for i := pos + 1; i < len(text); i++ {
+		switch {
+		case escapes && text[i] == '\\':
+			i++
+		case text[i] == quote:
+			return i + 1
+		case text[i] == '\n' && escapes:
+			// Unterminated; don't let it swallow the rest of the block.
+			return i
+		}
+	}
+	return len(text)
+}
+
+// Scans a number starting at pos, returns its end.
+func (lx *codeLexer) scanNumber(pos int) int {
+	text := lx.text
+	exponents := "eE"
+	if strings.HasPrefix(text[pos:], "0x") || strings.HasPrefix(text[pos:], "0X") {
+		exponents = "pP"
+	}
+
+	i := pos
+	for i < len(text) {
+		ch := text[i]
+		if isWord(ch) || ch == '.' || ch == '\'' && !lx.lang.asm {
+			// C++14 allows ' as a digit separator
+			i++
+		} else if (ch == '+' || ch == '-') && i > pos && strings.IndexByte(exponents, text[i-1]) != -1 {
+			// exponent sign
+			i++
+		} else {
+			break
+		}
+	}
+	return i
+}
+
+func (lx *codeLexer) classifyWord(word string, end int) string {
+	lang := lx.lang
+	key := word
+	if lang.ignoreCase {
+		key = strings.ToLower(word)
+	}
+
+	// Next non-blank character, to spot labels and calls
+	next := byte(0)
+	for i := end; i < len(lx.text); i++ {
+		if lx.text[i] != ' ' && lx.text[i] != '\t' {
+			next = lx.text[i]
+			break
+		}
+	}
+
+	if lang.asm {
+		switch {
+		case next == ':' && !lx.sawMnemonic:
+			return "label"
+		case lang.registers[strings.TrimPrefix(key, "%")]:
+			return "register"
+		case strings.HasPrefix(word, "."):
+			lx.sawMnemonic = true
+			return "directive"
+		case !lx.sawMnemonic:
+			lx.sawMnemonic = true
+			return "op-code"
+		case lang.keywords[key]:
+			return "keyword"
+		}
+		return ""
+	}
+
+	switch {
+	case lang.keywords[key]:
+		return "keyword"
+	case lang.builtins[key]:
+		return "builtin"
+	case next == '(':
+		return "function"
+	}
+	return ""
+}
+
+func (lx *codeLexer) run() []codeToken {
+	lang := lx.lang
+	text := lx.text
+	lx.lineStart = true
+
+scan:
+	for lx.pos < len(text) {
+		pos := lx.pos
+		ch := text[pos]
+
+		if ch == '\n' {
+			lx.lineStart = true
+			lx.sawMnemonic = false
+			lx.emit("", pos+1)
+			continue
+		}
+		if isSpace(ch) {
+			lx.emit("", pos+1)
+			continue
+		}
+
+		wasLineStart := lx.lineStart
+		lx.lineStart = false
+
+		for _, prefix := range lang.lineComments {
+			if strings.HasPrefix(text[pos:], prefix) {
+				lx.emit("comment", lx.endOfLine(pos))
+				continue scan
+			}
+		}
+		for _, delims := range lang.blockComments {
+			if strings.HasPrefix(text[pos:], delims[0]) {
+				end := len(text)
+				if idx := strings.Index(text[pos+len(delims[0]):], delims[1]); idx != -1 {
+					end = pos + len(delims[0]) + idx + len(delims[1])
+				}
+				lx.emit("comment", end)
+				continue scan
+			}
+		}
+
+		switch {
+		case lang.preprocessor && wasLineStart && ch == '#':
+			// Directives run to the end of the line, including continuations.
+			end := lx.endOfLine(pos)
+			for end < len(text) && strings.HasSuffix(strings.TrimRight(text[pos:end], "\r"), "\\") {
+				end = lx.endOfLine(end + 1)
+			}
+			lx.emit("macro", end)
+
+		case strings.IndexByte(lang.quotes, ch) != -1 || strings.IndexByte(lang.rawQuotes, ch) != -1:
+			lx.emit("string", lx.scanString(pos))
+
+		case ch >= '0' && ch <= '9' || ch == '.' && pos+1 < len(text) && text[pos+1] >= '0' && text[pos+1] <= '9':
+			lx.emit("number", lx.scanNumber(pos))
+
+		case lang.decorators && ch == '@' && pos+1 < len(text) && lx.isIdentStart(text[pos+1]):
+			end := pos + 1
+			for end < len(text) && (lx.isIdentChar(text[end]) || text[end] == '.') {
+				end++
+			}
+			lx.emit("decorator", end)
+
+		case lx.isIdentStart(ch):
+			end := pos + 1
+			for end < len(text) && lx.isIdentChar(text[end]) {
+				end++
+			}
+			lx.emit(lx.classifyWord(text[pos:end], end), end)
+
+		case strings.IndexByte("{}[]();,.:", ch) != -1:
+			lx.emit("punctuation", pos+1)
+
+		case strings.IndexByte("+-*/%=<>!&|^~?#", ch) != -1:
+			lx.emit("operator", pos+1)
+
+		default:
+			lx.emit("", pos+1)
+		}
+	}
+	return lx.tokens
+}
+
+// Parses line ranges of the form "1,3-5,8" (as used by Prism's data-line
+// attribute). Line numbers start at 1; lines past numLines are ignored.
+func parseLineRanges(spec string, numLines int) (map[int]bool, error) {
+	lines := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last := part, part
+		if idx := strings.IndexByte(part, '-'); idx != -1 {
+			first, last = part[:idx], part[idx+1:]
+		}
+		a, errA := strconv.Atoi(strings.TrimSpace(first))
+		b, errB := strconv.Atoi(strings.TrimSpace(last))
+		if errA != nil || errB != nil || a < 1 || b < a {
+			return nil, fmt.Errorf("bad line range %q", part)
+		}
+		for i := a; i <= min(b, numLines); i++ {
+			lines[i] = true
+		}
+	}
+	return lines, nil
+}
+
+// Writes highlighted code to out. Lines in highlight are wrapped in a
+// "highlight-line" span.
+func highlightCode(out *bytes.Buffer, lang *language, code string, highlight map[int]bool) {
+	lx := &codeLexer{lang: lang, text: code}
+	tokens := lx.run()
+
+	line := 1
+	startLine := func() {
+		if highlight[line] {
+			out.WriteString(`<span class="highlight-line">`)
+		}
+	}
+	endLine := func() {
+		if highlight[line] {
+			out.WriteString("</span>")
+		}
+	}
+
+	startLine()
+	for _, tok := range tokens {
+		// Tokens can span lines (comments, strings); spans get closed and
+		// reopened around line breaks so line wrappers nest properly.
+		parts := strings.Split(tok.text, "\n")
+		for i, part := range parts {
+			if i > 0 {
+				endLine()
+				out.WriteByte('\n')
+				line++
+				startLine()
+			}
+			if part == "" {
+				continue
+			}
+			if tok.kind != "" {
+				fmt.Fprintf(out, `<span class="token %s">`, tok.kind)
+			}
+			out.WriteString(html.EscapeString(part))
+			if tok.kind != "" {
+				out.WriteString("</span>")
+			}
+		}
+	}
+	endLine()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseLineRanges(t *testing.T) {
+	tests := []struct {
+		spec     string
+		numLines int
+		want     []int // nil for an error
+	}{
+		{"", 10, []int{}},
+		{"3", 10, []int{3}},
+		{"1,3-5,8", 10, []int{1, 3, 4, 5, 8}},
+		{" 2 - 3 , 7 ", 10, []int{2, 3, 7}},
+		{"1,,2", 10, []int{1, 2}},
+		{"4-4", 10, []int{4}},
+		{"8-12", 10, []int{8, 9, 10}},
+		{"20", 10, []int{}},
+		{"1-2000000000", 3, []int{1, 2, 3}},
+		{"0", 10, nil},
+		{"5-3", 10, nil},
+		{"a", 10, nil},
+		{"1-", 10, nil},
+		{"-2", 10, nil},
+	}
+	for _, test := range tests {
+		lines, err := parseLineRanges(test.spec, test.numLines)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.spec, lines)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err.Error())
+			continue
+		}
+		want := make(map[int]bool)
+		for _, line := range test.want {
+			want[line] = true
+		}
+		if !reflect.DeepEqual(lines, want) {
+			t.Errorf("%q: got %v, want %v", test.spec, lines, want)
+		}
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	tests := []struct {
+		lang, code string
+		highlight  map[int]bool
+		want       string
+	}{
+		{"c", `int a = 0x1F; /* c */ 'c'`, nil,
+			`<span class="token keyword">int</span> a <span class="token operator">=</span> <span class="token number">0x1F</span><span class="token punctuation">;</span> <span class="token comment">/* c */</span> <span class="token string">&#39;c&#39;</span>`},
+		{"go", "// hi\nreturn x", map[int]bool{2: true},
+			"<span class=\"token comment\">// hi</span>\n<span class=\"highlight-line\"><span class=\"token keyword\">return</span> x</span>"},
+		{"go", "a <b", nil,
+			`a <span class="token operator">&lt;</span>b`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		highlightCode(&buf, languages[test.lang], test.code, test.highlight)
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s %q:\n got %s\nwant %s", test.lang, test.code, got, test.want)
+		}
+	}
+}
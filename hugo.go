@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Imports the content of a Hugo site. Pages in sections (content/posts/...)
+// become posts, the ones directly in content/ become standalone pages. The
+// files of page bundles go to the posts' asset directories.
+
+var (
+	hugoContentName = regexp.MustCompile(`\.(?:md|markdown|html)$`)
+	hugoVar         = regexp.MustCompile(`:[a-z]+`)
+
+	hugoHighlight = regexp.MustCompile(`(?s)\{\{[<%]\s*highlight\s+"?([\w+#-]+)"?[^}]*[>%]\}\}\n?(.*?)\{\{[<%]\s*/highlight\s*[>%]\}\}`)
+	hugoRef       = regexp.MustCompile(`\{\{[<%]\s*(?:rel)?ref\s+"([^"]+)"\s*[>%]\}\}`)
+	hugoFigure    = regexp.MustCompile(`\{\{[<%]\s*figure\s+(.*?)\s*/?[>%]\}\}`)
+	hugoShortcode = regexp.MustCompile(`\{\{[<%]\s*([\w-]+)`)
+)
+
+// Hugo reads the first of these it finds.
+var hugoConfigFiles = []string{"hugo.toml", "hugo.yaml", "hugo.yml", "config.toml", "config.yaml", "config.yml"}
+
+func runImportHugo(blog *Blog, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import hugo <site dir>")
+	}
+	dir := args[0]
+
+	config, err := readHugoConfig(dir)
+	if err != nil {
+		return err
+	}
+	configString := func(key, def string) string {
+		if s, ok := config[key].(string); ok && s != "" {
+			return s
+		}
+		return def
+	}
+	permalinks := make(map[string]string)
+	if m, ok := config["permalinks"].(map[string]interface{}); ok {
+		for section, pattern := range m {
+			if s, ok := pattern.(string); ok {
+				permalinks[strings.ToLower(section)] = s
+			}
+		}
+	}
+
+	contentDir := filepath.Join(dir, configString("contentdir", "content"))
+	si := newSiteImport(blog, contentDir, filepath.Join(dir, configString("staticdir", "static")), configString("baseurl", ""))
+	for _, key := range []string{"url", "publishdate", "layout", "weight"} {
+		si.ignore[key] = true
+	}
+
+	err = filepath.Walk(contentDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(contentDir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			// Leaf bundles: the directory is the post.
+			for _, name := range []string{"index.md", "index.markdown", "index.html"} {
+				if _, err := os.Stat(filepath.Join(file, name)); err == nil {
+					if err := si.readHugoPost(path.Join(rel, name), rel, permalinks); err != nil {
+						return err
+					}
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+
+		switch {
+		case strings.HasPrefix(path.Base(rel), "_index."):
+			si.warnf(rel, "list page not imported")
+		case hugoContentName.MatchString(rel):
+			return si.readHugoPost(rel, "", permalinks)
+		case path.Dir(rel) == ".":
+			si.warnf(rel, "not a content file, skipped")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	si.convert(convertHugoCode, si.convertHugoShortcodes)
+	return si.finish()
+}
+
+func readHugoConfig(dir string) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+	for _, name := range hugoConfigFiles {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		raw := make(map[string]interface{})
+		if strings.HasSuffix(name, ".toml") {
+			err = toml.Unmarshal(data, &raw)
+		} else {
+			err = yaml.Unmarshal(data, &raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+
+		// Hugo config keys aren't case sensitive.
+		for key, value := range raw {
+			config[strings.ToLower(key)] = value
+		}
+		break
+	}
+	return config, nil
+}
+
+// Reads a content file; bundle is the directory of its page bundle, if
+// it's in one.
+func (si *siteImport) readHugoPost(file, bundle string, permalinks map[string]string) error {
+	sp, err := si.readPost(file)
+	if err != nil {
+		return err
+	}
+	sp.bundle = bundle
+
+	if value := sp.take("date", "publishdate"); value != nil {
+		if t, ok := importTime(value); ok {
+			sp.published = t
+		} else {
+			si.warnf(file, "couldn't parse date %v", value)
+		}
+	}
+
+	// Bundles are named after their directory, other pages after their file.
+	name := strings.TrimSuffix(path.Base(file), path.Ext(file))
+	if bundle != "" {
+		name = path.Base(bundle)
+	}
+	where := file
+	if bundle != "" {
+		where = bundle
+	}
+	section := ""
+	if i := strings.IndexByte(where, '/'); i != -1 {
+		section = where[:i]
+	}
+	page := section == ""
+	if !page && sp.published.IsZero() {
+		si.warnf(file, "no date, skipped")
+		return nil
+	}
+
+	sp.oldUrl = si.hugoUrl(sp, name, section, permalinks)
+	si.addPost(sp, name)
+	si.setProperties(sp, page)
+
+	// {{< ref >}} takes paths with or without extension, relative to the
+	// content directory, or just the name if that's unique.
+	ref := strings.TrimSuffix(file, path.Ext(file))
+	if bundle != "" {
+		ref = bundle
+		si.addKey("file:"+bundle+"/", sp)
+	}
+	si.addKey("file:"+file, sp)
+	si.addKey("file:"+ref, sp)
+	si.addKey("name:"+name, sp)
+	si.addKey("name:"+path.Base(file), sp)
+
+	if bundle != "" {
+		return si.addBundle(sp)
+	}
+	return nil
+}
+
+// Works out the URL a page had on the Hugo site: the url property, or the
+// permalink pattern for its section, or Hugo's default.
+func (si *siteImport) hugoUrl(sp *sitePost, name, section string, permalinks map[string]string) string {
+	if url, ok := sp.props["url"].(string); ok && url != "" {
+		return url
+	}
+
+	title, _ := sp.props["title"].(string)
+	slug, _ := sp.props["slug"].(string)
+	pattern, ok := permalinks[section]
+	if !ok {
+		pattern = "/:section/:slugorfilename/"
+	}
+
+	t := sp.published
+	unknown := ""
+	url := hugoVar.ReplaceAllStringFunc(pattern, func(v string) string {
+		switch v {
+		case ":year":
+			return t.Format("2006")
+		case ":month":
+			return t.Format("01")
+		case ":monthname":
+			return strings.ToLower(t.Format("January"))
+		case ":day":
+			return t.Format("02")
+		case ":section":
+			return section
+		case ":title":
+			// Hugo "urlizes" titles, which slugify is near enough to.
+			return slugify(title)
+		case ":slug":
+			if slug != "" {
+				return slug
+			}
+			return slugify(title)
+		case ":filename", ":contentbasename":
+			return name
+		case ":slugorfilename", ":slugorcontentbasename":
+			if slug != "" {
+				return slug
+			}
+			return name
+		}
+		unknown = v
+		return v
+	})
+	if unknown != "" {
+		si.warnf(sp.file, "permalink variable %q isn't supported, so the old URL is unknown", unknown)
+		return ""
+	}
+
+	// Hugo lower-cases paths by default.
+	url = strings.ToLower(url)
+	if strings.HasSuffix(url, "/") {
+		return path.Clean(url) + "/"
+	}
+	return path.Clean(url)
+}
+
+// {{< highlight lang >}} blocks become fenced code.
+func convertHugoCode(sp *sitePost, text string) string {
+	return hugoHighlight.ReplaceAllStringFunc(text, func(m string) string {
+		sub := hugoHighlight.FindStringSubmatch(m)
+		return fencedCode(sub[1], sub[2])
+	})
+}
+
+func (si *siteImport) convertHugoShortcodes(sp *sitePost, text string) string {
+	text = hugoRef.ReplaceAllStringFunc(text, func(m string) string {
+		ref := hugoRef.FindStringSubmatch(m)[1]
+		fragment := ""
+		if i := strings.IndexByte(ref, '#'); i != -1 {
+			ref, fragment = ref[:i], ref[i:]
+		}
+		if ref == "" {
+			return fragment
+		}
+
+		keys := []string{"file:" + strings.TrimPrefix(ref, "/"), "name:" + ref}
+		if !strings.HasPrefix(ref, "/") {
+			keys = append([]string{"file:" + path.Join(path.Dir(sp.file), ref)}, keys...)
+		}
+		for _, key := range keys {
+			if other := si.lookup[key]; other != nil {
+				return "*" + other.id + fragment
+			}
+		}
+		si.warnf(sp.file, "ref %q doesn't go to an imported post", ref)
+		return m
+	})
+
+	text = hugoFigure.ReplaceAllStringFunc(text, func(m string) string {
+		args := parseAttrs(hugoFigure.FindStringSubmatch(m)[1])
+		if args["src"] == "" {
+			return m
+		}
+		img := fmt.Sprintf("![%s](%s", markdownText(args["alt"]), args["src"])
+		if args["title"] != "" {
+			img += fmt.Sprintf(" %q", args["title"])
+		}
+		img += ")"
+		if args["link"] != "" {
+			si.warnf(sp.file, "figure link %q dropped", args["link"])
+		}
+		return figureShortcode(img, args["caption"])
+	})
+
+	si.unknownTags(sp, text, hugoShortcode, "shortcode")
+	return text
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Bump this when changing how thumbnails are generated, to invalidate the
+// image cache.
+const thumbnailVersion = 1
+
+// JPEG quality for downscaled images.
+const thumbnailJpegQuality = 90
+
+// A downscaled version of an image.
+type imageVariant struct {
+	uri    string
+	width  int
+	height int
+}
+
+// Height of an image of size cfg scaled to the given width (preserving
+// the aspect ratio).
+func scaledHeight(cfg image.Config, width int) int {
+	return int((int64(cfg.Height)*int64(width) + int64(cfg.Width/2)) / int64(cfg.Width))
+}
+
+// Widths to generate downscaled images at, in increasing order. Always
+// includes MaxImageWidth, since that's what we display wide images at;
+// ImageWidths adds more for srcset.
+func (blog *Blog) variantWidths() []int {
+	widths := []int{blog.MaxImageWidth}
+	for _, w := range blog.ImageWidths {
+		if w != blog.MaxImageWidth {
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+// File extensions for the image formats we can downscale, by the names
+// image.DecodeConfig gives them.
+var variantExts = map[string]string{
+	"png":  ".png",
+	"jpeg": ".jpg",
+}
+
+// Generates downscaled versions of the local image src (available as uri)
+// for all configured widths smaller than the image, and adds them to the
+// blog as static files. Returns them ordered by width. The variants get the
+// extension of the image's actual format, which needn't match its name.
+func (blog *Blog) imageVariants(post *Post, uri, src string, cfg image.Config, format string) ([]imageVariant, error) {
+	ext, ok := variantExts[format]
+	if !ok {
+		return nil, nil
+	}
+
+	var variants []imageVariant
+	for _, width := range blog.variantWidths() {
+		if width >= cfg.Width {
+			break
+		}
+
+		height := scaledHeight(cfg, width)
+		cachePath, err := blog.thumbnail(src, ext, width, height)
+		if err != nil {
+			return nil, fmt.Errorf("%q: couldn't downscale image %q: %s", post.Id, src, err.Error())
+		}
+
+		vuri := fmt.Sprintf("%s.%dw%s", strings.TrimSuffix(uri, path.Ext(uri)), width, ext)
+		if err = blog.AddStaticFile(vuri, cachePath); err != nil {
+			return nil, err
+		}
+		post.assets[vuri] = cachePath
+
+		variants = append(variants, imageVariant{vuri, width, height})
+	}
+	return variants, nil
+}
+
+// Returns the path of a downscaled version of src in the image cache,
+// generating it if necessary. ext goes with the format of src.
+func (blog *Blog) thumbnail(src, ext string, width, height int) (string, error) {
+	stamp, err := fileStampKey(src)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("v%d %s %s %dx%d", thumbnailVersion, src, stamp, width, height)
+	cachePath := filepath.Join(blog.ImageCacheDir, hashBytes([]byte(key))+ext)
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	img, format, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	if err := os.MkdirAll(blog.ImageCacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	// Several posts can reference the same image and they get rendered in
+	// parallel, so write to a temp file and rename it into place.
+	tmp, err := ioutil.TempFile(blog.ImageCacheDir, "tmp")
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case "png":
+		err = png.Encode(tmp, dst)
+	case "jpeg":
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: thumbnailJpegQuality})
+	default:
+		err = fmt.Errorf("don't know how to encode %s images", format)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cachePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// Deletes downscaled images that the current build doesn't use.
+func (blog *Blog) pruneImageCache() error {
+	entries, err := ioutil.ReadDir(blog.ImageCacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, src := range blog.files {
+		used[filepath.Clean(src)] = true
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(blog.ImageCacheDir, entry.Name())
+		if !entry.IsDir() && !used[path] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
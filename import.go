@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Importers convert posts from other blog engines into post files.
+var importers = map[string]struct {
+	args string // argument synopsis for usage
+	run  func(blog *Blog, args []string) error
+}{
+	"wordpress": {"<export.xml>", runImportWordpress},
+	"jekyll":    {"<site dir>", runImportJekyll},
+	"hugo":      {"<site dir>", runImportHugo},
+}
+
+func runImport(blog *Blog, args []string) error {
+	cmd := findCommand("import")
+	flags := newFlagSet(cmd)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s import <format> [arguments]\n\nFormats:\n", filepath.Base(os.Args[0]))
+		var names []string
+		for name := range importers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s %s\n", name, importers[name].args)
+		}
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	importer, ok := importers[flags.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown import format %q.", flags.Arg(0))
+	}
+	return importer.run(blog, flags.Args()[1:])
+}
+
+// A post converted by an importer, ready to be written out.
+type importedPost struct {
+	id     string
+	header [][2]string       // properties, in order
+	body   string            // markdown
+	assets map[string]string // files for the post's asset directory: relative path -> source file
+}
+
+func (post *importedPost) set(key, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		post.header = append(post.header, [2]string{key, value})
+	}
+}
+
+func (post *importedPost) setList(key string, values []string) {
+	post.set(key, strings.Join(values, ", "))
+}
+
+// Contents of the post file, with a dash-syntax header.
+func (post *importedPost) contents() []byte {
+	var buf bytes.Buffer
+	for _, prop := range post.header {
+		// Header values need to stay on their line.
+		fmt.Fprintf(&buf, "-%s=%s\n", prop[0], strings.Join(strings.Fields(prop[1]), " "))
+	}
+	buf.WriteString("\n")
+	buf.WriteString(strings.TrimSpace(post.body))
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// Runs of blank lines, as left over from converting blocks.
+var extraBlankLines = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)+`)
+
+// A figure shortcode around a markdown image, with a caption if there is
+// one, on lines of its own.
+func figureShortcode(img, caption string) string {
+	if caption = strings.TrimSpace(caption); caption == "" {
+		return fmt.Sprintf("\n\n{%% figure %%}\n%s\n{%% endfigure %%}\n\n", img)
+	}
+	return fmt.Sprintf("\n\n{%% figure %%}\n%s\n{%% figcaption %%}%s{%% endfigcaption %%}\n{%% endfigure %%}\n\n", img, caption)
+}
+
+// Is id usable as a post ID (and file name)?
+func validPostId(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/\\. \t\n")
+}
+
+// Creates a new post file, failing if it already exists.
+func createPostFile(blog *Blog, id string, contents []byte) (string, error) {
+	path := filepath.Join(blog.PostDir, id+".md")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("%q: post file %q already exists.", id, path)
+		}
+		return "", err
+	}
+	_, err = file.Write(contents)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return path, err
+}
+
+// Adds a file to the post's asset directory, under the given name unless
+// another file already has it. Returns the name used.
+func (post *importedPost) addAsset(name, src string) string {
+	if post.assets == nil {
+		post.assets = make(map[string]string)
+	}
+	dir, base := path.Split(name)
+	for n := 2; ; n++ {
+		if other, taken := post.assets[name]; !taken || other == src {
+			post.assets[name] = src
+			return name
+		}
+		name = fmt.Sprintf("%s%d-%s", dir, n, base)
+	}
+}
+
+// Writes imported posts and their assets. Checks first that none of them
+// exist yet, so an import either happens completely or not at all.
+func writeImportedPosts(blog *Blog, posts []*importedPost) error {
+	if err := os.MkdirAll(blog.PostDir, 0755); err != nil {
+		return err
+	}
+
+	// Posts can be in subdirectories too.
+	files, err := blog.findPostFiles()
+	if err != nil {
+		return err
+	}
+	existing := make(map[PostID]string)
+	for _, file := range files {
+		existing[file.id] = file.path
+	}
+
+	seen := make(map[string]bool)
+	for _, post := range posts {
+		if seen[post.id] {
+			return fmt.Errorf("%q: imported twice.", post.id)
+		}
+		seen[post.id] = true
+
+		if path, ok := existing[PostID(post.id)]; ok {
+			return fmt.Errorf("%q: post file %q already exists.", post.id, path)
+		}
+		for name := range post.assets {
+			path := filepath.Join(blog.PostDir, post.id, filepath.FromSlash(name))
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%q: asset %q already exists.", post.id, path)
+			}
+		}
+	}
+
+	for _, post := range posts {
+		path, err := createPostFile(blog, post.id, post.contents())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created %q\n", path)
+
+		for name, src := range post.assets {
+			dst := filepath.Join(blog.PostDir, post.id, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if err := copyFile(dst, src); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Name of the home page template in TemplateDir. Sites without one get a
+// copy of the most recent post as their home page.
+const indexTemplateName = "index.html"
+
+// What the home page template sees. Like postInfo, but for a page of
+// posts.
+type indexInfo struct {
+	Posts    []*Post // posts on this page, most recent first
+	Page     int     // page number, starting at 1
+	NumPages int
+	Newer    template.URL // previous page, if any
+	Older    template.URL // next page, if any
+	Links    []indexPageLink
+	Blog     *blogView
+	Recent   []*Post
+}
+
+// A link to one of the home pages, for page number navigation.
+type indexPageLink struct {
+	Page    int
+	Href    template.URL
+	Current bool
+}
+
+// Name of the given home page.
+func indexPageName(page int) string {
+	if page == 1 {
+		return "index.html"
+	}
+	return fmt.Sprintf("page%d.html", page)
+}
+
+// Link to the given home page.
+func (blog *Blog) homeLink(page int) template.URL {
+	if page == 1 {
+		return template.URL(blog.linkTo(""))
+	}
+	return template.URL(blog.linkTo(indexPageName(page)))
+}
+
+// Loads the home page template, if there is one.
+func (blog *Blog) loadIndexTemplate() (*template.Template, error) {
+	text, err := ioutil.ReadFile(filepath.Join(blog.TemplateDir, indexTemplateName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return template.New("index").Parse(string(text))
+}
+
+// Number of home pages, at NumIndexPosts posts each.
+func (blog *Blog) numIndexPages() int {
+	numPages := (len(blog.PostsByDate) + blog.NumIndexPosts - 1) / blog.NumIndexPosts
+	if numPages == 0 {
+		// Still want a home page.
+		numPages = 1
+	}
+	return numPages
+}
+
+// Splits the posts up into home pages of NumIndexPosts each.
+func (blog *Blog) indexPages(view *blogView, recent []*Post) []*indexInfo {
+	numPages := blog.numIndexPages()
+	var pages []*indexInfo
+	for page := 1; page <= numPages; page++ {
+		start := (page - 1) * blog.NumIndexPosts
+		end := min(start+blog.NumIndexPosts, len(blog.PostsByDate))
+		info := &indexInfo{
+			Posts:    blog.PostsByDate[start:end],
+			Page:     page,
+			NumPages: numPages,
+			Blog:     view,
+			Recent:   recent,
+		}
+		if page > 1 {
+			info.Newer = blog.homeLink(page - 1)
+		}
+		if page < numPages {
+			info.Older = blog.homeLink(page + 1)
+		}
+		for i := 1; i <= numPages; i++ {
+			info.Links = append(info.Links, indexPageLink{i, blog.homeLink(i), i == page})
+		}
+		pages = append(pages, info)
+	}
+	return pages
+}
+
+// Writes a single home page to the output.
+func (blog *Blog) writeIndexPage(info *indexInfo, tmpl *template.Template) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, info); err != nil {
+		return err
+	}
+	return blog.writeOutputFile(indexPageName(info.Page), buf.Bytes())
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Imports the posts (and drafts) of a Jekyll site. Site-root files linked
+// from posts, such as images in /assets, get copied to the posts' asset
+// directories.
+
+// Jekyll's built-in permalink styles.
+var jekyllPermalinkStyles = map[string]string{
+	"date":    "/:categories/:year/:month/:day/:title:output_ext",
+	"pretty":  "/:categories/:year/:month/:day/:title/",
+	"ordinal": "/:categories/:year/:y_day/:title:output_ext",
+	"none":    "/:categories/:title:output_ext",
+}
+
+var (
+	jekyllPostName  = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)\.(?:md|markdown|mkd|mkdn|html)$`)
+	jekyllDraftName = regexp.MustCompile(`^(.+)\.(?:md|markdown|mkd|mkdn|html)$`)
+	jekyllVar       = regexp.MustCompile(`:[a-z_]+`)
+
+	jekyllHighlight = regexp.MustCompile(`(?s)\{%-?\s*highlight\s+([\w+#-]+)[^%]*-?%\}\n?(.*?)\{%-?\s*endhighlight\s*-?%\}`)
+	jekyllRaw       = regexp.MustCompile(`\{%-?\s*(?:end)?raw\s*-?%\}`)
+	jekyllPostRef   = regexp.MustCompile(`\{%-?\s*(post_url|link)\s+(\S+)\s*-?%\}`)
+	jekyllTag       = regexp.MustCompile(`\{%-?\s*(\w+)`)
+	jekyllOutput    = regexp.MustCompile(`\{\{-?\s*([^}]*?)\s*-?\}\}`)
+
+	// Site-root links are written with these, to include the base path.
+	jekyllSiteUrl   = regexp.MustCompile(`\{\{-?\s*site\.(?:url|baseurl)\s*-?\}\}`)
+	jekyllUrlFilter = regexp.MustCompile(`\{\{-?\s*["']([^"']*)["']\s*\|\s*(?:relative|absolute)_url\s*-?\}\}`)
+)
+
+func runImportJekyll(blog *Blog, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import jekyll <site dir>")
+	}
+	dir := args[0]
+
+	var config struct {
+		Permalink string `yaml:"permalink"`
+		Url       string `yaml:"url"`
+		BaseUrl   string `yaml:"baseurl"`
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "_config.yml"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("_config.yml: %s", err.Error())
+	}
+	if config.Permalink == "" {
+		config.Permalink = "date"
+	}
+	if style, ok := jekyllPermalinkStyles[config.Permalink]; ok {
+		config.Permalink = style
+	}
+
+	si := newSiteImport(blog, dir, dir, strings.TrimSuffix(config.Url, "/")+config.BaseUrl)
+	for _, key := range []string{"layout", "permalink"} {
+		si.ignore[key] = true
+	}
+
+	for _, sub := range []string{"_posts", "_drafts"} {
+		err := filepath.Walk(filepath.Join(dir, sub), func(file string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) && file == filepath.Join(dir, sub) {
+				return filepath.SkipDir
+			}
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, file)
+			if err != nil {
+				return err
+			}
+			return si.readJekyllPost(filepath.ToSlash(rel), sub == "_drafts", config.Permalink, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	si.convert(convertJekyllCode, si.convertJekyllTags)
+	return si.finish()
+}
+
+func (si *siteImport) readJekyllPost(file string, draft bool, permalink string, info os.FileInfo) error {
+	name := path.Base(file)
+	var date, title string
+	if draft {
+		m := jekyllDraftName.FindStringSubmatch(name)
+		if m == nil {
+			si.warnf(file, "not a post, skipped")
+			return nil
+		}
+		title = m[1]
+	} else {
+		m := jekyllPostName.FindStringSubmatch(name)
+		if m == nil {
+			si.warnf(file, "not named like a post (YYYY-MM-DD-title.md), skipped")
+			return nil
+		}
+		date, title = m[1], m[2]
+	}
+
+	sp, err := si.readPost(file)
+	if err != nil {
+		return err
+	}
+
+	// The date in the front matter wins over the one in the file name.
+	// Drafts don't have either, usually.
+	if value := sp.take("date"); value != nil {
+		if t, ok := importTime(value); ok {
+			sp.published = t
+		} else {
+			si.warnf(sp.file, "couldn't parse date %v", value)
+		}
+	}
+	if sp.published.IsZero() && date != "" {
+		sp.published, _ = parseTime(date)
+	}
+	if sp.published.IsZero() {
+		sp.published = info.ModTime()
+	}
+	if draft {
+		sp.props["draft"] = true
+	} else {
+		sp.oldUrl = jekyllUrl(sp, title, permalink)
+	}
+
+	si.addPost(sp, title)
+	si.setProperties(sp, false)
+
+	// {% post_url 2012-03-04-title %} and {% link _posts/2012-03-04-title.md %}
+	si.addKey("post_url:"+strings.TrimSuffix(strings.TrimPrefix(file, "_posts/"), path.Ext(file)), sp)
+	si.addKey("post_url:"+strings.TrimSuffix(name, path.Ext(name)), sp)
+	si.addKey("file:"+file, sp)
+	return nil
+}
+
+// Works out the URL a post had on the Jekyll site.
+func jekyllUrl(sp *sitePost, title, permalink string) string {
+	if p, ok := sp.props["permalink"].(string); ok && p != "" {
+		permalink = p
+	}
+
+	slug := title
+	if s, ok := sp.props["slug"].(string); ok && s != "" {
+		slug = s
+	}
+	var categories []string
+	for _, c := range importList(sp.props["categories"]) {
+		categories = append(categories, strings.ToLower(c))
+	}
+	if c, ok := sp.props["category"].(string); ok && len(categories) == 0 {
+		categories = []string{strings.ToLower(c)}
+	}
+
+	t := sp.published
+	url := jekyllVar.ReplaceAllStringFunc(permalink, func(v string) string {
+		switch v {
+		case ":year":
+			return t.Format("2006")
+		case ":short_year":
+			return t.Format("06")
+		case ":month":
+			return t.Format("01")
+		case ":i_month":
+			return t.Format("1")
+		case ":day":
+			return t.Format("02")
+		case ":i_day":
+			return t.Format("2")
+		case ":y_day":
+			return fmt.Sprintf("%03d", t.YearDay())
+		case ":hour":
+			return t.Format("15")
+		case ":minute":
+			return t.Format("04")
+		case ":second":
+			return t.Format("05")
+		case ":title":
+			return title
+		case ":slug":
+			return slug
+		case ":categories":
+			return strings.Join(categories, "/")
+		case ":output_ext":
+			return ".html"
+		}
+		return v
+	})
+	if strings.HasSuffix(url, "/") {
+		return path.Clean(url) + "/"
+	}
+	return path.Clean(url)
+}
+
+// {% highlight lang %} blocks become fenced code.
+func convertJekyllCode(sp *sitePost, text string) string {
+	return jekyllHighlight.ReplaceAllStringFunc(text, func(m string) string {
+		sub := jekyllHighlight.FindStringSubmatch(m)
+		return fencedCode(sub[1], sub[2])
+	})
+}
+
+func (si *siteImport) convertJekyllTags(sp *sitePost, text string) string {
+	text = jekyllRaw.ReplaceAllString(text, "")
+	text = jekyllSiteUrl.ReplaceAllString(text, "")
+	text = jekyllUrlFilter.ReplaceAllString(text, "$1")
+	text = jekyllPostRef.ReplaceAllStringFunc(text, func(m string) string {
+		sub := jekyllPostRef.FindStringSubmatch(m)
+		key := "post_url:" + sub[2]
+		if sub[1] == "link" {
+			key = "file:" + strings.TrimPrefix(sub[2], "/")
+		}
+		if other := si.lookup[key]; other != nil {
+			return "*" + other.id
+		}
+		si.warnf(sp.file, "%s %q doesn't go to an imported post", sub[1], sub[2])
+		return m
+	})
+
+	si.unknownTags(sp, text, jekyllTag, "Liquid tag")
+	si.unknownTags(sp, text, jekyllOutput, "Liquid output")
+	return text
+}
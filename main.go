@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,38 +13,77 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.blog/pkg/atom"
 )
 
 type Blog struct {
-	// Configuration options
-	Title          string
-	Tagline        string
-	Hostname       string
-	Url            string
-	Author         string
-	AtomFeedFile   string
-	NumRecentPosts int
-	NumFeedPosts   int
-	MaxImageWidth  int // if images are wider than this, build a thumbnail.
-	PostDir        string
-	TemplateDir    string
-	OutDir         string
+	// Configuration options (read from the site config file)
+	Title          string `json:"title"`
+	Tagline        string `json:"tagline"`
+	Hostname       string `json:"hostname"`
+	Url            string `json:"url"`
+	Author         string `json:"author"`
+	AtomFeedFile   string `json:"atom_feed_file"`
+	NumRecentPosts int    `json:"num_recent_posts"`
+	NumFeedPosts   int    `json:"num_feed_posts"`
+	NumIndexPosts  int    `json:"num_index_posts"` // posts per home page, if there's an index.html template.
+	SummaryWords   int    `json:"summary_words"`   // length of automatic summaries.
+	FeedSummaries  bool   `json:"feed_summaries"`  // put summaries instead of full posts into feeds.
+	RssFeedFile    string `json:"rss_feed_file"`   // e.g. "feed.rss.xml"; empty (the default) for no RSS feed.
+	NumRssPosts    int    `json:"num_rss_posts"`
+	JsonFeedFile   string `json:"json_feed_file"` // e.g. "feed.json"; empty (the default) for no JSON feed.
+	NumJsonPosts   int    `json:"num_json_posts"`
+	MaxImageWidth  int    `json:"max_image_width"` // if images are wider than this, build a thumbnail.
+	ImageWidths    []int  `json:"image_widths"`    // widths of further downscaled images offered via srcset; none by default.
+	ImageCacheDir  string `json:"image_cache_dir"` // where downscaled images are kept between builds.
+	Highlight      string `json:"highlight"`       // "client" (the default) to leave code to JS, "server" to highlight it at build time where possible.
+	Math           string `json:"math"`            // "mathjax" (the default) to leave math to JS, "mathml" to convert it at build time where possible.
+	PostDir        string `json:"post_dir"`
+	TemplateDir    string `json:"template_dir"`
+	OutDir         string `json:"out_dir"`
+	Workers        int    `json:"workers"`        // number of parallel workers; 0 means one per CPU.
+	Permalink      string `json:"permalink"`      // URL pattern for posts, e.g. "/:year/:month/:slug/".
+	PagePermalink  string `json:"page_permalink"` // URL pattern for pages and collections.
+
+	RedirectMaps []string `json:"redirect_maps"` // redirect files to write for aliases: "netlify", "apache" and/or "nginx".
+
+	ParamSchema map[string]*ParamSpec `json:"params"` // custom post properties; if empty, anything goes.
+
+	// Set from the command line
+	IncludeDrafts bool `json:"-"` // publish posts marked as drafts
+	IncludeFuture bool `json:"-"` // publish posts dated in the future
 
 	// Posts
-	AllPosts    []*Post // master list of all posts in the blog (includes regular posts and special pages)
-	MostRecent  *Post   // most recently added post
-	Pages       []*Post // standalone pages
-	PostsByDate []*Post // posts sorted by date (this is really only posts, not standalone pages)
-	Series      []*Post // list of parent posts for series
-	Collections []*Post // list of root posts for collections
+	AllPosts    []*Post `json:"-"` // master list of all posts in the blog (includes regular posts and special pages)
+	MostRecent  *Post   `json:"-"` // most recently added post
+	Pages       []*Post `json:"-"` // standalone pages
+	PostsByDate []*Post `json:"-"` // posts sorted by date (this is really only posts, not standalone pages)
+	Series      []*Post `json:"-"` // list of root posts of series (not of their parts)
+	Collections []*Post `json:"-"` // list of root posts for collections
+	Unpublished []*Post `json:"-"` // drafts and scheduled posts, which don't get written
+	Tags        []*Tag  `json:"-"` // all tags used by posts, sorted by name
+	TagPages    []*Post `json:"-"` // generated per-tag index pages
+
+	Feeds []*FeedLink `json:"-"` // site-wide feeds, for autodiscovery
 
 	// Files
-	files map[string]string // dst_path (relative to output) -> src_path (relative to blog root)
+	files   map[string]string // dst_path (relative to output) -> src_path (relative to blog root)
+	filesMu sync.Mutex        // guards files during parallel rendering
+
+	shortcodes   map[string]shortcodeFunc
+	shortcodeKey string // hash of the shortcode templates
 
 	atomFeed []byte
+	rssFeed  []byte
+	jsonFeed []byte
+
+	homePages []string   // file names of the home pages written by writeOutputPosts
+	redirects []redirect // from aliases, see AssignPermalinks
+	cache     *buildCache
+	stageDir  string // output is written here, then swapped in for OutDir
 }
 
 func Warnf(msg string, args ...interface{}) {
@@ -92,43 +133,131 @@ func (blog *Blog) AddStaticFiles() error {
 	return err
 }
 
+// A post file found under PostDir.
+type postFile struct {
+	id       PostID
+	path     string
+	assetDir string // where the post's images are
+}
+
+// Finds all post files below PostDir. A post is either <id>.md, with its
+// images in the directory <id> next to it, or <id>/index.md with its images
+// beside it (a page bundle). Other directories, say one per year, only
+// organize posts and don't affect their IDs. Files are returned in a
+// fixed order, and an ID can only be used once.
+func (blog *Blog) findPostFiles() ([]postFile, error) {
+	var files []postFile
+	seen := make(map[PostID]string)
+	add := func(id, path, assetDir string) error {
+		if other, ok := seen[PostID(id)]; ok {
+			return fmt.Errorf("%q: defined by both %q and %q.", id, other, path)
+		}
+		seen[PostID(id)] = path
+		files = append(files, postFile{PostID(id), path, assetDir})
+		return nil
+	}
+
+	err := filepath.Walk(blog.PostDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if path == blog.PostDir {
+			return nil
+		}
+		if strings.HasPrefix(name, ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			index := filepath.Join(path, "index.md")
+			if _, err := os.Stat(index); err == nil {
+				if err := add(name, index, path); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			// The asset directory of <id>.md isn't searched for posts.
+			if _, err := os.Stat(path + ".md"); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Ext(name) == ".md" {
+			id := strings.TrimSuffix(name, ".md")
+			return add(id, path, filepath.Join(filepath.Dir(path), id))
+		}
+		return nil
+	})
+	return files, err
+}
+
 // Reads the text files describing all posts from the file system.
 func (blog *Blog) ReadPosts() error {
-	files, err := filepath.Glob(filepath.Join(blog.PostDir, "*.md"))
+	files, err := blog.findPostFiles()
 	if err != nil {
 		return err
 	}
 
 	blog.AllPosts = make([]*Post, 0, len(files))
 	for _, file := range files {
-		text, err := ioutil.ReadFile(file)
+		text, err := ioutil.ReadFile(file.path)
 		if err != nil {
 			return err
 		}
 
-		// Generate ID from file name by stripping extension
-		id := filepath.Base(file)
-		if idx := strings.LastIndex(id, "."); idx != -1 {
-			id = id[:idx]
-		}
-
-		post, err := NewPost(id, text)
+		post, err := NewPost(string(file.id), text)
 		if err != nil {
 			return err
 		}
+		post.assetDir = file.assetDir
+		if err = blog.applyParamSchema(post); err != nil {
+			return err
+		}
 
 		blog.AllPosts = append(blog.AllPosts, post)
 	}
 	return nil
 }
 
+// Returns the file defining the post with the given ID, if there is one.
+func (blog *Blog) postFileFor(id PostID) (string, error) {
+	files, err := blog.findPostFiles()
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, file := range files {
+		if file.id == id {
+			return file.path, nil
+		}
+	}
+	return "", nil
+}
+
 // Perform inter-post linkage.
 func (blog *Blog) LinkPosts() error {
 	// Sort all posts by ID in increasing order.
 	sort.Sort(postsById(blog.AllPosts))
 
 	// Handle links between posts
+	now := time.Now()
 	for _, post := range blog.AllPosts {
+		// Unpublished posts don't get indexed or linked into series. Parts
+		// of a series wait for the series to be published.
+		post.unpublished = !blog.shouldPublish(post, now)
+		if parent := blog.unpublishedAncestor(post, now); !post.unpublished && parent != nil {
+			Warnf("%q: not published, since %q, which it's part of, isn't.", post.Id, parent.Id)
+			post.unpublished = true
+		}
+		if post.unpublished {
+			blog.Unpublished = append(blog.Unpublished, post)
+			continue
+		}
+
 		// Which index does this end up in?
 		if post.Standalone() {
 			blog.Pages = append(blog.Pages, post)
@@ -150,17 +279,27 @@ func (blog *Blog) LinkPosts() error {
 
 	}
 
+	if err := checkParentCycles(blog.AllPosts); err != nil {
+		return err
+	}
+	sortSeries(blog.AllPosts)
+
 	// Sort posts by date
 	sort.Sort(postsByPublishDate(blog.PostsByDate))
 
 	// Second pass: index series
 	for _, post := range blog.PostsByDate {
-		// If a post has child posts, it's a series.
-		if post.Kids != nil {
+		// If a post has child posts, it's a series; parts that have
+		// parts of their own belong to the series above them.
+		if post.Kids != nil && post.Parent == nil {
 			blog.Series = append(blog.Series, post)
 		}
 	}
 
+	if err := blog.indexTags(); err != nil {
+		return err
+	}
+
 	if len(blog.PostsByDate) > 0 {
 		blog.MostRecent = blog.PostsByDate[0]
 	}
@@ -168,6 +307,31 @@ func (blog *Blog) LinkPosts() error {
 	return nil
 }
 
+// The closest of the post's parents (and their parents) that isn't
+// published in the current build, if any.
+func (blog *Blog) unpublishedAncestor(post *Post, now time.Time) *Post {
+	// Cycles are only reported later on.
+	seen := map[*Post]bool{post: true}
+	for p := blog.FindPostById(post.parentId); p != nil && !seen[p]; p = blog.FindPostById(p.parentId) {
+		if !blog.shouldPublish(p, now) {
+			return p
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// Should this post be published in the current build?
+func (blog *Blog) shouldPublish(post *Post, now time.Time) bool {
+	if post.Draft && !blog.IncludeDrafts {
+		return false
+	}
+	if !post.Standalone() && post.Published.After(now) && !blog.IncludeFuture {
+		return false
+	}
+	return true
+}
+
 // Find a post by its ID. This is only guaranteed to work after LinkPosts.
 func (blog *Blog) FindPostById(which PostID) *Post {
 	for _, post := range blog.AllPosts {
@@ -183,52 +347,294 @@ type postInfo struct {
 	Docs   []*Post // list of all docs for this page
 	Next   *Post
 	Prev   *Post
-	Blog   *Blog
+	Blog   *blogView
 	Recent []*Post
 }
 
+// What templates see as the blog. Pages are rendered in parallel, so
+// instead of flagging the shared root post as active, each page gets its own
+// copy of the post lists in which the root post is replaced by an active
+// copy.
+type blogView struct {
+	*Blog
+	AllPosts    []*Post
+	MostRecent  *Post
+	Pages       []*Post
+	PostsByDate []*Post
+	Series      []*Post
+	Collections []*Post
+	TagPages    []*Post
+}
+
+// Returns a copy of info with the root post marked active.
+func (info postInfo) withActiveRoot() postInfo {
+	blog := info.Blog.Blog
+	root := info.Root
+
+	active := *root
+	active.Active = true
+
+	// Series navigation goes through the parents, so they need to see the
+	// active post among their kids, all the way up.
+	for kid, orig := &active, root; orig.Parent != nil; orig = orig.Parent {
+		parent := *orig.Parent
+		parent.Kids = replacePost(parent.Kids, orig, kid)
+		kid.Parent = &parent
+		kid = &parent
+	}
+
+	swap := func(p *Post) *Post {
+		if p == root {
+			return &active
+		}
+		return p
+	}
+
+	info.Root = &active
+	info.Docs = replacePost(info.Docs, root, &active)
+	info.Next = swap(info.Next)
+	info.Prev = swap(info.Prev)
+	info.Recent = replacePost(info.Recent, root, &active)
+	info.Blog = &blogView{
+		Blog:        blog,
+		AllPosts:    replacePost(blog.AllPosts, root, &active),
+		MostRecent:  swap(blog.MostRecent),
+		Pages:       replacePost(blog.Pages, root, &active),
+		PostsByDate: replacePost(blog.PostsByDate, root, &active),
+		Series:      replacePost(blog.Series, root, &active),
+		Collections: replacePost(blog.Collections, root, &active),
+		TagPages:    replacePost(blog.TagPages, root, &active),
+	}
+	return info
+}
+
+// Returns list with all occurrences of old replaced by new. The original
+// list is never modified.
+func replacePost(list []*Post, old, new *Post) []*Post {
+	for i, p := range list {
+		if p == old {
+			out := make([]*Post, len(list))
+			copy(out, list)
+			for j := i; j < len(out); j++ {
+				if out[j] == old {
+					out[j] = new
+				}
+			}
+			return out
+		}
+	}
+	return list
+}
+
 func (blog *Blog) RenderPosts() error {
-	// Render all posts' contents
-	for _, post := range blog.AllPosts {
+	if blog.cache == nil {
+		blog.cache = loadBuildCache(cacheFileName)
+	}
+
+	// Render all posts' contents, reusing cached renders where possible
+	config, err := json.Marshal(blog)
+	if err != nil {
+		return err
+	}
+	linkContext := blog.linkContextKey()
+	err = parallelFor(blog.Workers, len(blog.AllPosts), func(i int) error {
+		post := blog.AllPosts[i]
+		if post.unpublished {
+			return nil
+		}
+
+		key := post.renderKey(blog, config, linkContext)
+		if blog.cache.restoreRender(blog, post, key) {
+			return nil
+		}
 		if err := post.Render(blog); err != nil {
 			return err
 		}
+		if !post.Standalone() {
+			if err := post.RenderFeed(blog); err != nil {
+				return err
+			}
+		}
+		blog.cache.storeRender(post, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Report formulas that need MathJax
+	for _, post := range blog.AllPosts {
+		if post.unpublished {
+			continue
+		}
+		for _, msg := range post.mathErrors {
+			Warnf("%q: using MathJax for %s", post.Id, msg)
+		}
 	}
-	blog.renderAtomFeed()
-	return nil
+
+	if err = blog.renderFeeds(); err != nil {
+		return err
+	}
+	return blog.renderTagFeeds()
 }
 
-func (blog *Blog) WriteOutput() error {
-	// Wipe existing output dir
-	if err := os.RemoveAll(blog.OutDir); err != nil {
+// Writes the whole site to a staging directory next to OutDir, then swaps
+// it in, so OutDir always contains a complete build. The previous build is
+// kept in a backup directory for rollback.
+func (blog *Blog) WriteOutput() (err error) {
+	blog.stageDir = blog.OutDir + ".new"
+	if err = os.RemoveAll(blog.stageDir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(blog.stageDir, 0733); err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(blog.stageDir)
+		}
+	}()
 
 	// Static files
-	for dst, src := range blog.files {
-		// Make sure the path exists
-		outPath := filepath.Join(blog.OutDir, filepath.FromSlash(dst))
-		if err := os.MkdirAll(filepath.Dir(outPath), 0733); err != nil {
+	dsts := make([]string, 0, len(blog.files))
+	for dst := range blog.files {
+		dsts = append(dsts, dst)
+	}
+	sort.Strings(dsts)
+	err = parallelFor(blog.Workers, len(dsts), func(i int) error {
+		return blog.writeStaticFile(dsts[i], blog.files[dsts[i]])
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = blog.writeOutputPosts(); err != nil {
+		return err
+	}
+
+	if err = blog.writeFeeds(); err != nil {
+		return err
+	}
+
+	if err = blog.writeSitemap(); err != nil {
+		return err
+	}
+
+	if err = blog.writeRedirects(); err != nil {
+		return err
+	}
+
+	if err = swapDirs(blog.stageDir, blog.OutDir, blog.backupDir()); err != nil {
+		return err
+	}
+
+	if err = blog.pruneImageCache(); err != nil {
+		return err
+	}
+
+	return blog.cache.save(cacheFileName)
+}
+
+// Directory holding the previous build.
+func (blog *Blog) backupDir() string {
+	return blog.OutDir + ".old"
+}
+
+// Makes src the new dst, moving the current dst (if any) to backup. There's
+// no portable way to replace a directory in one step, but the window in
+// which dst doesn't exist is just between two renames.
+func swapDirs(src, dst, backup string) error {
+	if err := os.RemoveAll(backup); err != nil {
+		return err
+	}
+
+	hadDst := true
+	if err := os.Rename(dst, backup); err != nil {
+		if !os.IsNotExist(err) {
 			return err
 		}
+		hadDst = false
+	}
 
-		// Copy the file
-		if err := copyFile(outPath, src); err != nil {
-			return err
+	if err := os.Rename(src, dst); err != nil {
+		if hadDst {
+			os.Rename(backup, dst)
 		}
+		return err
 	}
+	return nil
+}
 
-	if err := blog.writeOutputPosts(); err != nil {
+// Restores the previous build. The current build becomes the backup, so
+// rolling back twice gets it back.
+func (blog *Blog) RollbackOutput() error {
+	backup := blog.backupDir()
+	if _, err := os.Stat(backup); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%q: no previous build to roll back to.", backup)
+		}
 		return err
 	}
 
-	if err := blog.writeAtomFeed(); err != nil {
+	tmp := blog.OutDir + ".rollback"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(backup, tmp); err != nil {
+		return err
+	}
+	if err := swapDirs(tmp, blog.OutDir, backup); err != nil {
 		return err
 	}
 
+	// The cache describes the build we just moved out of the way.
+	if err := os.Remove(cacheFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
+// Path of an output file in the staging directory.
+func (blog *Blog) stagePath(dst string) string {
+	return filepath.Join(blog.stageDir, filepath.FromSlash(dst))
+}
+
+// Copies a static file to the output. If it's unchanged since the last
+// build, the existing output is reused instead.
+func (blog *Blog) writeStaticFile(dst, src string) error {
+	stamp, err := fileStampKey(src)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the path exists
+	outPath := blog.stagePath(dst)
+	if err := os.MkdirAll(filepath.Dir(outPath), 0733); err != nil {
+		return err
+	}
+
+	if blog.cache.output(blog, dst, "static:"+src+":"+stamp) {
+		return linkOrCopyFile(outPath, filepath.Join(blog.OutDir, filepath.FromSlash(dst)))
+	}
+	return copyFile(outPath, src)
+}
+
+// Writes a generated file to the output. If the previous build wrote the
+// same contents, the existing output is reused instead.
+func (blog *Blog) writeOutputFile(dst string, data []byte) error {
+	outPath := blog.stagePath(dst)
+	if err := os.MkdirAll(filepath.Dir(outPath), 0733); err != nil {
+		return err
+	}
+
+	if blog.cache.output(blog, dst, hashBytes(data)) {
+		return linkOrCopyFile(outPath, filepath.Join(blog.OutDir, filepath.FromSlash(dst)))
+	}
+
+	fmt.Printf("writing %q\n", dst)
+	return ioutil.WriteFile(outPath, data, 0644)
+}
+
 // Writes all posts to the output
 func (blog *Blog) writeOutputPosts() error {
 	tmpl_text, err := ioutil.ReadFile(filepath.Join(blog.TemplateDir, "template.html"))
@@ -241,120 +647,224 @@ func (blog *Blog) writeOutputPosts() error {
 		return err
 	}
 
+	indexTmpl, err := blog.loadIndexTemplate()
+	if err != nil {
+		return err
+	}
+
 	recent := blog.PostsByDate[:min(len(blog.PostsByDate), blog.NumRecentPosts)]
+	view := &blogView{
+		Blog:        blog,
+		AllPosts:    blog.AllPosts,
+		MostRecent:  blog.MostRecent,
+		Pages:       blog.Pages,
+		PostsByDate: blog.PostsByDate,
+		Series:      blog.Series,
+		Collections: blog.Collections,
+		TagPages:    blog.TagPages,
+	}
 
-	// Render pages
-	for _, page := range blog.Pages {
-		fmt.Printf("processing %q\n", page.Title)
-		postinfo := postInfo{
-			Root:   page,
-			Docs:   []*Post{page},
-			Blog:   blog,
-			Recent: recent,
+	// Work out what to write first, then do the actual writing in parallel.
+	type outputJob struct {
+		desc  string // for progress output
+		info  postInfo
+		dst   string
+		index bool       // also write as index.html?
+		home  *indexInfo // home page instead of a post
+	}
+	var jobs []*outputJob
+
+	// Home pages
+	blog.homePages = nil
+	if indexTmpl != nil {
+		for _, page := range blog.indexPages(view, recent) {
+			blog.homePages = append(blog.homePages, indexPageName(page.Page))
+			jobs = append(jobs, &outputJob{
+				desc: fmt.Sprintf("home page %d", page.Page),
+				home: page,
+			})
 		}
+	}
 
-		if err = blog.writeOutputPost(&postinfo, tmpl, filepath.Join(blog.OutDir, page.RenderedName())); err != nil {
-			return err
-		}
+	// Pages
+	for _, page := range blog.Pages {
+		jobs = append(jobs, &outputJob{
+			desc: fmt.Sprintf("%q", page.Title),
+			info: postInfo{
+				Root:   page,
+				Docs:   []*Post{page},
+				Blog:   view,
+				Recent: recent,
+			},
+			dst: page.RenderedName(),
+		})
+	}
+
+	// Tag index pages
+	for _, page := range blog.TagPages {
+		jobs = append(jobs, &outputJob{
+			desc: fmt.Sprintf("%q", page.Title),
+			info: postInfo{
+				Root:   page,
+				Docs:   []*Post{page},
+				Blog:   view,
+				Recent: recent,
+			},
+			dst: page.RenderedName(),
+		})
 	}
 
-	// Render regular posts
+	// Regular posts
 	for idx, post := range blog.PostsByDate {
-		fmt.Printf("processing %q\n", post.Title)
+		job := &outputJob{
+			desc: fmt.Sprintf("%q", post.Title),
+			info: postInfo{
+				Root:   post,
+				Docs:   []*Post{post},
+				Blog:   view,
+				Recent: recent,
+			},
+			dst: post.RenderedName(),
 
-		postinfo := postInfo{
-			Root:   post,
-			Docs:   []*Post{post},
-			Blog:   blog,
-			Recent: recent,
+			// Without a home page template, the most recent post doubles
+			// as index.html.
+			index: post == blog.MostRecent && indexTmpl == nil,
 		}
-		outname := filepath.Join(blog.OutDir, post.RenderedName())
 
 		if idx > 0 {
-			postinfo.Next = blog.PostsByDate[idx-1]
+			job.info.Next = blog.PostsByDate[idx-1]
 		}
 
 		if idx+1 < len(blog.PostsByDate) {
-			postinfo.Prev = blog.PostsByDate[idx+1]
+			job.info.Prev = blog.PostsByDate[idx+1]
 		}
 
-		if err = blog.writeOutputPost(&postinfo, tmpl, outname); err != nil {
-			return err
-		}
-
-		// If this is the most recent post, make a copy for index.html.
-		if post == blog.MostRecent {
-			if err = copyFile(filepath.Join(blog.OutDir, "index.html"), outname); err != nil {
-				return err
-			}
-		}
+		jobs = append(jobs, job)
 	}
 
-	// Render collections
+	// Collections
 	for _, root := range blog.Collections {
-		fmt.Printf("processing collection %q\n", root.Title)
-
-		postinfo := postInfo{
-			Root:   root,
-			Docs:   root.Kids,
-			Blog:   blog,
-			Recent: recent,
-		}
-		sort.Sort(postsByPublishDateAsc(postinfo.Docs))
+		docs := seriesDocs(root.Kids)
 
 		// union of source render flags
-		for _, post := range root.Kids {
+		for _, post := range docs {
 			root.MathJax = root.MathJax || post.MathJax
 			root.BlockCode = root.BlockCode || post.BlockCode
 		}
 
-		outname := filepath.Join(blog.OutDir, root.RenderedName())
-		if err = blog.writeOutputPost(&postinfo, tmpl, outname); err != nil {
-			return err
-		}
+		jobs = append(jobs, &outputJob{
+			desc: fmt.Sprintf("collection %q", root.Title),
+			info: postInfo{
+				Root:   root,
+				Docs:   docs,
+				Blog:   view,
+				Recent: recent,
+			},
+			dst: root.RenderedName(),
+		})
 	}
 
-	return nil
-}
+	return parallelFor(blog.Workers, len(jobs), func(i int) error {
+		job := jobs[i]
+		fmt.Printf("processing %s\n", job.desc)
 
-// Writes a single post to the output
-func (blog *Blog) writeOutputPost(info *postInfo, tmpl *template.Template, outname string) error {
-	outfile, err := os.Create(outname)
-	if err != nil {
+		if job.home != nil {
+			return blog.writeIndexPage(job.home, indexTmpl)
+		}
+		data, err := blog.writeOutputPost(&job.info, tmpl, job.dst)
+		if err == nil && job.index {
+			err = blog.writeOutputFile("index.html", data)
+		}
 		return err
+	})
+}
+
+// Writes a single post to the output. Returns the generated page.
+func (blog *Blog) writeOutputPost(info *postInfo, tmpl *template.Template, dst string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, info.withActiveRoot()); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), blog.writeOutputFile(dst, buf.Bytes())
+}
 
-	info.Root.Active = true
-	err = tmpl.Execute(outfile, info)
-	info.Root.Active = false
+func (blog *Blog) writeFeeds() error {
+	feeds := []struct {
+		file string
+		data []byte
+	}{
+		{blog.AtomFeedFile, blog.atomFeed},
+		{blog.RssFeedFile, blog.rssFeed},
+		{blog.JsonFeedFile, blog.jsonFeed},
+	}
+	for _, feed := range feeds {
+		if feed.file == "" {
+			continue
+		}
+		if err := blog.writeOutputFile(feed.file, feed.data); err != nil {
+			return err
+		}
+	}
 
-	outfile.Close()
-	return err
+	for _, tag := range blog.Tags {
+		if err := blog.writeOutputFile(tag.FeedFile, tag.atomFeed); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (blog *Blog) writeAtomFeed() error {
-	outfile, err := os.Create(filepath.Join(blog.OutDir, blog.AtomFeedFile))
-	if err != nil {
+// Prefix for all Atom IDs.
+func (blog *Blog) atomIdBase() string {
+	return blog.Url + "/block/"
+}
+
+// Renders the site-wide feeds in all configured formats.
+func (blog *Blog) renderFeeds() (err error) {
+	feed := &feedInfo{
+		Title:       blog.Title,
+		Id:          blog.atomIdBase(),
+		Alternate:   blog.Url,
+		Description: blog.Tagline,
+		posts:       blog.PostsByDate,
+	}
+
+	blog.Feeds = nil
+	if blog.atomFeed, err = blog.atomFeedFor(feed, blog.AtomFeedFile, blog.NumFeedPosts); err != nil {
 		return err
 	}
+	blog.addFeedLink("application/atom+xml", blog.AtomFeedFile)
+
+	if blog.RssFeedFile != "" {
+		if blog.rssFeed, err = blog.rssFeedFor(feed, blog.RssFeedFile, blog.NumRssPosts); err != nil {
+			return err
+		}
+		blog.addFeedLink("application/rss+xml", blog.RssFeedFile)
+	}
 
-	_, err = outfile.Write(blog.atomFeed)
-	outfile.Close()
+	if blog.JsonFeedFile != "" {
+		if blog.jsonFeed, err = blog.jsonFeedFor(feed, blog.JsonFeedFile, blog.NumJsonPosts); err != nil {
+			return err
+		}
+		blog.addFeedLink("application/feed+json", blog.JsonFeedFile)
+	}
 	return nil
 }
 
-func (blog *Blog) renderAtomFeed() error {
-	feed := atom.Feed{
-		Title: blog.Title,
-		ID:    blog.Url + "/block/",
+// Renders an Atom feed with the first n entries of feed.
+func (blog *Blog) atomFeedFor(feed *feedInfo, feedFile string, n int) ([]byte, error) {
+	out := atom.Feed{
+		Title: feed.Title,
+		ID:    feed.Id,
 		Link: []atom.Link{
 			{
 				Rel:  "self",
-				Href: blog.Url + "/" + blog.AtomFeedFile,
+				Href: blog.Url + "/" + feedFile,
 			},
 			{
 				Rel:  "alternate",
-				Href: blog.Url,
+				Href: feed.Alternate,
 			},
 		},
 		Author: &atom.Person{
@@ -362,37 +872,50 @@ func (blog *Blog) renderAtomFeed() error {
 		},
 	}
 
-	var updated time.Time
-	for i, post := range blog.PostsByDate {
-		if i >= blog.NumFeedPosts {
-			break
-		}
-		if post.Updated.After(updated) {
-			updated = post.Updated
-		}
+	entries, updated := blog.feedEntries(feed.posts, n)
+	for _, entry := range entries {
 		e := &atom.Entry{
-			Title: post.Title,
-			ID:    feed.ID + post.AssetPath(),
+			Title: entry.Title,
+			ID:    entry.Id,
 			Link: []atom.Link{{
 				Rel:  "alternate",
-				Href: blog.Url + "/" + post.RenderedName(),
+				Href: entry.Url,
 			}},
-			Published: atom.Time(post.Published),
-			Updated:   atom.Time(post.Updated),
+			Published: atom.Time(entry.Published),
+			Updated:   atom.Time(entry.Updated),
 			Content: &atom.Text{
 				Type: "html",
-				Body: string(post.Content),
+				Body: entry.Content,
 			},
 		}
-		feed.Entry = append(feed.Entry, e)
+		if entry.Summary != "" {
+			e.Summary = &atom.Text{
+				Type: "text",
+				Body: entry.Summary,
+			}
+		}
+		out.Entry = append(out.Entry, e)
 	}
-	feed.Updated = atom.Time(updated)
-	data, err := xml.Marshal(&feed)
+	out.Updated = atom.Time(updated)
+	return xml.Marshal(&out)
+}
+
+// Hard-links srcname to dstname, or copies it if that fails. Either way
+// the modification time is preserved, so deploys can tell the file is
+// unchanged.
+func linkOrCopyFile(dstname, srcname string) error {
+	if err := os.Link(srcname, dstname); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(srcname)
 	if err != nil {
 		return err
 	}
-	blog.atomFeed = data
-	return nil
+	if err := copyFile(dstname, srcname); err != nil {
+		return err
+	}
+	return os.Chtimes(dstname, info.ModTime(), info.ModTime())
 }
 
 func copyFile(dstname, srcname string) error {
@@ -457,6 +980,9 @@ func (blog *Blog) GenerateCollections() error {
 
 // Adds a static file to the blog.
 func (blog *Blog) AddStaticFile(webpath, srcpath string) error {
+	blog.filesMu.Lock()
+	defer blog.filesMu.Unlock()
+
 	if val, in := blog.files[webpath]; in {
 		if val != srcpath {
 			return fmt.Errorf("Double definition for path %q - assigned to both %q and %q.", webpath, val, srcpath)
@@ -469,36 +995,34 @@ func (blog *Blog) AddStaticFile(webpath, srcpath string) error {
 
 func check(err error) {
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
 	}
 }
 
 func main() {
-	os.Chdir("c:/Store/Blog")
-
-	// Could (should?) read this from config file.
-	blog := &Blog{
-		Title:          "The ryg blog",
-		Tagline:        "When I grow up I'll be an inventor.",
-		Hostname:       "blog.rygorous.org",
-		Url:            "http://blog.rygorous.org/test",
-		Author:         "Fabian 'ryg' Giesen",
-		AtomFeedFile:   "feed.atom.xml",
-		NumRecentPosts: 5,
-		NumFeedPosts:   10,
-		MaxImageWidth:  700,
-		PostDir:        "posts",
-		TemplateDir:    "template",
-		OutDir:         "out",
-	}
-
-	check(blog.AddStaticFiles())
-	check(blog.ReadPosts())
-	check(blog.LinkPosts())
-	check(blog.GenerateArchive())
-	check(blog.GenerateCollections())
-	check(blog.RenderPosts())
-	check(blog.WriteOutput())
-
-	fmt.Println("Done!")
+	siteDir := flag.String("site", ".", "root directory of the site")
+	flag.Usage = usage
+	flag.Parse()
+
+	// Default is to build the site
+	name := "build"
+	args := flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	configPath, err := findConfig(*siteDir)
+	check(err)
+	check(os.Chdir(*siteDir))
+
+	blog := NewBlog()
+	check(blog.LoadConfig(filepath.Base(configPath)))
+	check(cmd.run(blog, args))
 }
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// Converts the subset of TeX math we use to MathML at build time, so
+// formulas show up without JavaScript and in feed readers. Anything the
+// converter doesn't understand is reported as an error, and the caller falls
+// back to MathJax for that formula.
+
+type mathSymbol struct {
+	tag  string // "mi", "mo" or "mn"
+	text string
+}
+
+var texSymbols = map[string]mathSymbol{}
+
+// Operators that take limits above and below in display mode.
+var texBigOps = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "bigcup": "⋃", "bigcap": "⋂",
+	"bigoplus": "⨁", "bigotimes": "⨂", "bigvee": "⋁", "bigwedge": "⋀",
+}
+
+// Integrals take their scripts on the side.
+var texIntegrals = map[string]string{
+	"int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+}
+
+// Named functions; the ones in texLimitFuncs take limits like big operators.
+var texFuncs = wordSet(`sin cos tan cot sec csc arcsin arccos arctan sinh cosh
+	tanh coth log ln lg exp det dim ker deg gcd arg hom Pr`)
+var texLimitFuncs = wordSet(`lim max min sup inf limsup liminf`)
+
+var texSpaces = map[string]string{
+	",": "0.167em", ":": "0.222em", ">": "0.222em", ";": "0.278em",
+	" ": "0.25em", "quad": "1em", "qquad": "2em", "!": "-0.167em",
+}
+
+var texAccents = map[string]struct {
+	char  string
+	under bool
+}{
+	"hat": {"^", false}, "widehat": {"^", false}, "bar": {"¯", false},
+	"overline": {"¯", false}, "vec": {"→", false}, "tilde": {"˜", false},
+	"widetilde": {"˜", false}, "dot": {"˙", false}, "ddot": {"¨", false},
+	"underline": {"_", true},
+}
+
+// Delimiters for \left, \right and matrix environments.
+var texDelims = map[string]string{
+	"(": "(", ")": ")", "[": "[", "]": "]", "|": "|", "/": "/", ".": "",
+	`\{`: "{", `\}`: "}", `\|`: "‖", `\langle`: "⟨", `\rangle`: "⟩",
+	`\lfloor`: "⌊", `\rfloor`: "⌋", `\lceil`: "⌈", `\rceil`: "⌉",
+	`\vert`: "|", `\Vert`: "‖", `\lvert`: "|", `\rvert`: "|",
+}
+
+var texMatrixDelims = map[string][2]string{
+	"matrix": {"", ""}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"},
+	"Bmatrix": {"{", "}"}, "vmatrix": {"|", "|"}, "Vmatrix": {"‖", "‖"},
+	"smallmatrix": {"", ""},
+}
+
+func init() {
+	greek := []struct{ name, char string }{
+		{"alpha", "α"}, {"beta", "β"}, {"gamma", "γ"}, {"delta", "δ"},
+		{"epsilon", "ϵ"}, {"varepsilon", "ε"}, {"zeta", "ζ"}, {"eta", "η"},
+		{"theta", "θ"}, {"vartheta", "ϑ"}, {"iota", "ι"}, {"kappa", "κ"},
+		{"lambda", "λ"}, {"mu", "μ"}, {"nu", "ν"}, {"xi", "ξ"}, {"pi", "π"},
+		{"varpi", "ϖ"}, {"rho", "ρ"}, {"varrho", "ϱ"}, {"sigma", "σ"},
+		{"varsigma", "ς"}, {"tau", "τ"}, {"upsilon", "υ"}, {"phi", "ϕ"},
+		{"varphi", "φ"}, {"chi", "χ"}, {"psi", "ψ"}, {"omega", "ω"},
+		{"Gamma", "Γ"}, {"Delta", "Δ"}, {"Theta", "Θ"}, {"Lambda", "Λ"},
+		{"Xi", "Ξ"}, {"Pi", "Π"}, {"Sigma", "Σ"}, {"Upsilon", "Υ"},
+		{"Phi", "Φ"}, {"Psi", "Ψ"}, {"Omega", "Ω"},
+	}
+	for _, g := range greek {
+		texSymbols[g.name] = mathSymbol{"mi", g.char}
+	}
+
+	ops := []struct{ name, char string }{
+		{"cdot", "⋅"}, {"times", "×"}, {"div", "÷"}, {"pm", "±"}, {"mp", "∓"},
+		{"ast", "∗"}, {"star", "⋆"}, {"circ", "∘"}, {"bullet", "∙"},
+		{"oplus", "⊕"}, {"otimes", "⊗"}, {"wedge", "∧"}, {"land", "∧"},
+		{"vee", "∨"}, {"lor", "∨"}, {"neg", "¬"}, {"lnot", "¬"},
+		{"cup", "∪"}, {"cap", "∩"}, {"setminus", "∖"},
+		{"leq", "≤"}, {"le", "≤"}, {"geq", "≥"}, {"ge", "≥"}, {"neq", "≠"},
+		{"ne", "≠"}, {"ll", "≪"}, {"gg", "≫"}, {"approx", "≈"},
+		{"equiv", "≡"}, {"sim", "∼"}, {"simeq", "≃"}, {"cong", "≅"},
+		{"propto", "∝"}, {"perp", "⊥"}, {"parallel", "∥"}, {"mid", "∣"},
+		{"in", "∈"}, {"notin", "∉"}, {"ni", "∋"}, {"subset", "⊂"},
+		{"subseteq", "⊆"}, {"supset", "⊃"}, {"supseteq", "⊇"},
+		{"to", "→"}, {"rightarrow", "→"}, {"leftarrow", "←"},
+		{"gets", "←"}, {"Rightarrow", "⇒"}, {"Leftarrow", "⇐"},
+		{"leftrightarrow", "↔"}, {"Leftrightarrow", "⇔"}, {"iff", "⟺"},
+		{"implies", "⟹"}, {"mapsto", "↦"}, {"uparrow", "↑"},
+		{"downarrow", "↓"}, {"forall", "∀"}, {"exists", "∃"},
+		{"ldots", "…"}, {"dots", "…"}, {"cdots", "⋯"}, {"vdots", "⋮"},
+		{"ddots", "⋱"}, {"langle", "⟨"}, {"rangle", "⟩"}, {"lfloor", "⌊"},
+		{"rfloor", "⌋"}, {"lceil", "⌈"}, {"rceil", "⌉"}, {"vert", "|"},
+		{"Vert", "‖"}, {"|", "‖"}, {"{", "{"}, {"}", "}"}, {"colon", ":"},
+		{"prime", "′"},
+	}
+	for _, o := range ops {
+		texSymbols[o.name] = mathSymbol{"mo", o.char}
+	}
+
+	idents := []struct{ name, char string }{
+		{"infty", "∞"}, {"partial", "∂"}, {"nabla", "∇"}, {"ell", "ℓ"},
+		{"hbar", "ℏ"}, {"emptyset", "∅"}, {"varnothing", "∅"},
+		{"Re", "ℜ"}, {"Im", "ℑ"}, {"aleph", "ℵ"},
+		{"%", "%"}, {"$", "$"}, {"#", "#"}, {"&", "&"}, {"_", "_"},
+	}
+	for _, i := range idents {
+		texSymbols[i.name] = mathSymbol{"mi", i.char}
+	}
+}
+
+// Unicode math alphanumerics for the font commands: start of the capital
+// letters, small letters and digits (0 if there are none), plus the
+// letters that live elsewhere in Unicode.
+var texFonts = map[string]struct {
+	upper, lower, digits rune
+	exceptions           map[rune]rune
+}{
+	"mathbf":     {0x1D400, 0x1D41A, 0x1D7CE, nil},
+	"boldsymbol": {0x1D468, 0x1D482, 0x1D7CE, nil},
+	"mathit":     {0x1D434, 0x1D44E, 0, map[rune]rune{'h': 'ℎ'}},
+	"mathsf":     {0x1D5A0, 0x1D5BA, 0x1D7E2, nil},
+	"mathtt":     {0x1D670, 0x1D68A, 0x1D7F6, nil},
+	"mathbb": {0x1D538, 0x1D552, 0x1D7D8, map[rune]rune{
+		'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ'}},
+	"mathcal": {0x1D49C, 0x1D4B6, 0, map[rune]rune{
+		'B': 'ℬ', 'E': 'ℰ', 'F': 'ℱ', 'H': 'ℋ', 'I': 'ℐ', 'L': 'ℒ', 'M': 'ℳ',
+		'R': 'ℛ', 'e': 'ℯ', 'g': 'ℊ', 'o': 'ℴ'}},
+	"mathfrak": {0x1D504, 0x1D51E, 0, map[rune]rune{
+		'C': 'ℭ', 'H': 'ℌ', 'I': 'ℑ', 'R': 'ℜ', 'Z': 'ℨ'}},
+}
+
+type texParser struct {
+	src     string
+	pos     int
+	display bool
+}
+
+func (p *texParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *texParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *texParser) skipSpace() {
+	for !p.eof() && isSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// Returns the next command name (without the backslash) if there is a
+// command at the current position, without consuming it.
+func (p *texParser) peekCommand() string {
+	if p.eof() || p.src[p.pos] != '\\' || p.pos+1 >= len(p.src) {
+		return ""
+	}
+	end := p.pos + 1
+	for end < len(p.src) && (p.src[end] >= 'a' && p.src[end] <= 'z' || p.src[end] >= 'A' && p.src[end] <= 'Z') {
+		end++
+	}
+	if end == p.pos+1 {
+		// single-character command like \{ or \,
+		return p.src[p.pos+1 : p.pos+2]
+	}
+	return p.src[p.pos+1 : end]
+}
+
+func (p *texParser) readCommand() string {
+	name := p.peekCommand()
+	p.pos += 1 + len(name)
+	return name
+}
+
+// Does the current position end a sequence?
+func (p *texParser) atSeqEnd() bool {
+	if p.eof() {
+		return true
+	}
+	switch p.src[p.pos] {
+	case '}', '&':
+		return true
+	}
+	switch p.peekCommand() {
+	case "\\", "end", "right":
+		return true
+	}
+	return false
+}
+
+// Parses a sequence of atoms up to the end of the enclosing construct.
+func (p *texParser) parseSeq() ([]string, error) {
+	var items []string
+	for {
+		p.skipSpace()
+		if p.atSeqEnd() {
+			return items, nil
+		}
+		item, err := p.parseScripted()
+		if err != nil {
+			return nil, err
+		}
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+}
+
+func mrow(items []string) string {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return "<mrow>" + strings.Join(items, "") + "</mrow>"
+}
+
+// Parses a braced group.
+func (p *texParser) parseGroup() (string, error) {
+	p.pos++ // '{'
+	items, err := p.parseSeq()
+	if err != nil {
+		return "", err
+	}
+	if p.eof() || p.src[p.pos] != '}' {
+		return "", p.errorf("expected '}'")
+	}
+	p.pos++
+	return mrow(items), nil
+}
+
+// Parses a command or macro argument: a group or a single atom.
+func (p *texParser) parseArg() (string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return "", p.errorf("missing argument")
+	}
+	if p.src[p.pos] == '{' {
+		return p.parseGroup()
+	}
+	// Unbraced arguments are a single token, so \frac12 is 1/2.
+	if ch := p.src[p.pos]; ch >= '0' && ch <= '9' {
+		p.pos++
+		return mathToken("mn", string(ch)), nil
+	}
+	item, _, err := p.parseAtom()
+	return item, err
+}
+
+// Reads the raw text of a braced argument.
+func (p *texParser) rawArg() (string, error) {
+	p.skipSpace()
+	if p.eof() || p.src[p.pos] != '{' {
+		return "", p.errorf("expected '{'")
+	}
+	depth := 0
+	for i := p.pos; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				text := p.src[p.pos+1 : i]
+				p.pos = i + 1
+				return text, nil
+			}
+		}
+	}
+	return "", p.errorf("unbalanced braces")
+}
+
+// Parses an atom with any sub- and superscripts and primes.
+func (p *texParser) parseScripted() (string, error) {
+	base, flags, err := p.parseAtom()
+	if err != nil {
+		return "", err
+	}
+
+	var sub string
+	var sup []string
+	primesOnly := true
+	for {
+		p.skipSpace()
+		if p.eof() {
+			break
+		}
+
+		switch p.peekCommand() {
+		case "limits":
+			p.readCommand()
+			flags |= atomLimits
+			continue
+		case "nolimits":
+			p.readCommand()
+			flags &^= atomLimits
+			continue
+		}
+
+		ch := p.src[p.pos]
+		if ch == '\'' {
+			primes := ""
+			for !p.eof() && p.src[p.pos] == '\'' {
+				primes += "′"
+				p.pos++
+			}
+			sup = append(sup, "<mo>"+primes+"</mo>")
+			continue
+		}
+		if ch != '^' && ch != '_' {
+			break
+		}
+
+		p.pos++
+		arg, err := p.parseArg()
+		if err != nil {
+			return "", err
+		}
+		if ch == '^' {
+			if !primesOnly {
+				return "", p.errorf("double superscript")
+			}
+			sup = append(sup, arg)
+			primesOnly = false
+		} else {
+			if sub != "" {
+				return "", p.errorf("double subscript")
+			}
+			sub = arg
+		}
+	}
+
+	if base == "" && (sub != "" || sup != nil) {
+		base = "<mrow></mrow>"
+	}
+
+	under, over, both := "msub", "msup", "msubsup"
+	if flags&atomLimits != 0 && p.display {
+		under, over, both = "munder", "mover", "munderover"
+	}
+	switch {
+	case sub != "" && sup != nil:
+		base = fmt.Sprintf("<%s>%s%s%s</%s>", both, base, sub, mrow(sup), both)
+	case sub != "":
+		base = fmt.Sprintf("<%s>%s%s</%s>", under, base, sub, under)
+	case sup != nil:
+		base = fmt.Sprintf("<%s>%s%s</%s>", over, base, mrow(sup), over)
+	}
+
+	// Named functions are followed by an invisible function application
+	// operator, which gets the spacing right.
+	if flags&atomFunc != 0 {
+		base += "<mo>\u2061</mo>"
+	}
+	return base, nil
+}
+
+func mathToken(tag, text string) string {
+	return "<" + tag + ">" + html.EscapeString(text) + "</" + tag + ">"
+}
+
+// Flags describing an atom.
+const (
+	atomLimits = 1 << iota // takes limits above and below in display mode
+	atomFunc               // named function like \sin
+)
+
+// Parses a single atom.
+func (p *texParser) parseAtom() (item string, flags int, err error) {
+	ch := p.src[p.pos]
+	switch {
+	case ch == '{':
+		item, err = p.parseGroup()
+		return
+
+	case ch == '\\':
+		return p.parseCommand()
+
+	case ch >= '0' && ch <= '9' || ch == '.' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9':
+		start := p.pos
+		for !p.eof() && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		return mathToken("mn", p.src[start:p.pos]), 0, nil
+
+	case ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z':
+		p.pos++
+		return mathToken("mi", string(ch)), 0, nil
+
+	case ch == '-':
+		p.pos++
+		return mathToken("mo", "−"), 0, nil
+
+	case ch == '~':
+		p.pos++
+		return `<mspace width="0.333em"/>`, 0, nil
+
+	case strings.IndexByte("+=<>*/|()[],;:!?.", ch) != -1:
+		p.pos++
+		return mathToken("mo", string(ch)), 0, nil
+
+	case ch == '^' || ch == '_':
+		// Scripts without a base
+		return "", 0, nil
+
+	case ch >= utf8.RuneSelf:
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += size
+		return mathToken("mi", string(r)), 0, nil
+	}
+
+	return "", 0, p.errorf("unexpected %q", ch)
+}
+
+func (p *texParser) parseCommand() (item string, flags int, err error) {
+	name := p.readCommand()
+
+	if sym, ok := texSymbols[name]; ok {
+		return mathToken(sym.tag, sym.text), 0, nil
+	}
+	if op, ok := texBigOps[name]; ok {
+		return `<mo largeop="true" movablelimits="true">` + op + "</mo>", atomLimits, nil
+	}
+	if op, ok := texIntegrals[name]; ok {
+		return `<mo largeop="true">` + op + "</mo>", 0, nil
+	}
+	if texFuncs[name] {
+		return mathToken("mi", name), atomFunc, nil
+	}
+	if texLimitFuncs[name] {
+		return mathToken("mi", name), atomFunc | atomLimits, nil
+	}
+	if width, ok := texSpaces[name]; ok {
+		return `<mspace width="` + width + `"/>`, 0, nil
+	}
+	if accent, ok := texAccents[name]; ok {
+		arg, err := p.parseArg()
+		if err != nil {
+			return "", 0, err
+		}
+		if accent.under {
+			return "<munder accentunder=\"true\">" + arg + "<mo>" + accent.char + "</mo></munder>", 0, nil
+		}
+		return "<mover accent=\"true\">" + arg + "<mo>" + accent.char + "</mo></mover>", 0, nil
+	}
+	if _, ok := texFonts[name]; ok {
+		text, err := p.rawArg()
+		if err != nil {
+			return "", 0, err
+		}
+		item, err := p.fontText(name, text)
+		return item, 0, err
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac":
+		num, err := p.parseArg()
+		if err != nil {
+			return "", 0, err
+		}
+		den, err := p.parseArg()
+		if err != nil {
+			return "", 0, err
+		}
+		return "<mfrac>" + num + den + "</mfrac>", 0, nil
+
+	case "binom":
+		n, err := p.parseArg()
+		if err != nil {
+			return "", 0, err
+		}
+		k, err := p.parseArg()
+		if err != nil {
+			return "", 0, err
+		}
+		return "<mrow><mo>(</mo><mfrac linethickness=\"0\">" + n + k + "</mfrac><mo>)</mo></mrow>", 0, nil
+
+	case "sqrt":
+		p.skipSpace()
+		var index string
+		if !p.eof() && p.src[p.pos] == '[' {
+			end := strings.IndexByte(p.src[p.pos:], ']')
+			if end == -1 {
+				return "", 0, p.errorf("unterminated root index")
+			}
+			sub := &texParser{src: p.src[p.pos+1 : p.pos+end], display: p.display}
+			items, err := sub.parseSeq()
+			if err != nil || !sub.eof() {
+				return "", 0, p.errorf("bad root index")
+			}
+			index = mrow(items)
+			p.pos += end + 1
+		}
+		arg, err := p.parseArg()
+		if err != nil {
+			return "", 0, err
+		}
+		if index != "" {
+			return "<mroot>" + arg + index + "</mroot>", 0, nil
+		}
+		return "<msqrt>" + arg + "</msqrt>", 0, nil
+
+	case "text", "textrm", "mbox", "textit", "textbf":
+		text, err := p.rawArg()
+		if err != nil {
+			return "", 0, err
+		}
+		return mathToken("mtext", text), 0, nil
+
+	case "mathrm", "operatorname":
+		text, err := p.rawArg()
+		if err != nil {
+			return "", 0, err
+		}
+		if !isPlainTexText(text) {
+			return "", 0, p.errorf("\\%s only supports plain text", name)
+		}
+		text = strings.TrimSpace(text)
+		if name == "operatorname" {
+			return mathToken("mi", text), atomFunc, nil
+		}
+		if utf8.RuneCountInString(text) == 1 {
+			return `<mi mathvariant="normal">` + html.EscapeString(text) + "</mi>", 0, nil
+		}
+		return mathToken("mi", text), 0, nil
+
+	case "left":
+		return p.parseLeftRight()
+
+	case "begin":
+		return p.parseEnvironment()
+
+	case "displaystyle", "textstyle", "nonumber", "notag":
+		return "", 0, nil
+	}
+
+	return "", 0, p.errorf("unsupported command \\%s", name)
+}
+
+func isPlainTexText(text string) bool {
+	for _, ch := range text {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == ' ' || ch == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts the argument of a font command like \mathbb to math
+// alphanumerics.
+func (p *texParser) fontText(font, text string) (string, error) {
+	f := texFonts[font]
+	var items []string
+	for _, ch := range text {
+		var r rune
+		tag := "mi"
+		switch {
+		case ch == ' ':
+			continue
+		case f.exceptions[ch] != 0:
+			r = f.exceptions[ch]
+		case ch >= 'A' && ch <= 'Z':
+			r = f.upper + (ch - 'A')
+		case ch >= 'a' && ch <= 'z':
+			r = f.lower + (ch - 'a')
+		case ch >= '0' && ch <= '9' && f.digits != 0:
+			r, tag = f.digits+(ch-'0'), "mn"
+		default:
+			return "", p.errorf("\\%s doesn't support %q", font, ch)
+		}
+		items = append(items, mathToken(tag, string(r)))
+	}
+	return mrow(items), nil
+}
+
+// Reads a delimiter after \left, \right or \big and friends.
+func (p *texParser) readDelim() (string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return "", p.errorf("missing delimiter")
+	}
+
+	key := p.src[p.pos : p.pos+1]
+	if key == "\\" {
+		key = "\\" + p.peekCommand()
+	}
+	delim, ok := texDelims[key]
+	if !ok {
+		return "", p.errorf("unsupported delimiter %q", key)
+	}
+	p.pos += len(key)
+	return delim, nil
+}
+
+func fence(delim string) string {
+	if delim == "" {
+		return ""
+	}
+	return `<mo fence="true" stretchy="true">` + html.EscapeString(delim) + "</mo>"
+}
+
+func (p *texParser) parseLeftRight() (string, int, error) {
+	left, err := p.readDelim()
+	if err != nil {
+		return "", 0, err
+	}
+	items, err := p.parseSeq()
+	if err != nil {
+		return "", 0, err
+	}
+	if p.peekCommand() != "right" {
+		return "", 0, p.errorf("\\left without \\right")
+	}
+	p.readCommand()
+	right, err := p.readDelim()
+	if err != nil {
+		return "", 0, err
+	}
+	return "<mrow>" + fence(left) + strings.Join(items, "") + fence(right) + "</mrow>", 0, nil
+}
+
+// Parses the rows and cells of a tabular environment, up to \end{name}.
+func (p *texParser) parseRows(name string) ([][]string, error) {
+	var rows [][]string
+	var row []string
+	for {
+		items, err := p.parseSeq()
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, mrow(items))
+
+		if p.eof() {
+			return nil, p.errorf("missing \\end{%s}", name)
+		}
+		if p.src[p.pos] == '&' {
+			p.pos++
+			continue
+		}
+
+		switch p.peekCommand() {
+		case "\\":
+			p.readCommand()
+			// Skip optional spacing like \\[2pt]
+			p.skipSpace()
+			if !p.eof() && p.src[p.pos] == '[' {
+				if end := strings.IndexByte(p.src[p.pos:], ']'); end != -1 {
+					p.pos += end + 1
+				}
+			}
+			rows = append(rows, row)
+			row = nil
+
+		case "end":
+			p.readCommand()
+			end, err := p.rawArg()
+			if err != nil {
+				return nil, err
+			}
+			if end != name {
+				return nil, p.errorf("\\begin{%s} ended by \\end{%s}", name, end)
+			}
+			// A trailing \\ doesn't start another row.
+			if len(row) > 1 || row[0] != "<mrow></mrow>" {
+				rows = append(rows, row)
+			}
+			return rows, nil
+
+		default:
+			return nil, p.errorf("unexpected %q in %s", p.src[p.pos], name)
+		}
+	}
+}
+
+func mtable(rows [][]string, attrs string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<mtable" + attrs + ">")
+	for _, row := range rows {
+		buf.WriteString("<mtr>")
+		for _, cell := range row {
+			buf.WriteString("<mtd>" + cell + "</mtd>")
+		}
+		buf.WriteString("</mtr>")
+	}
+	buf.WriteString("</mtable>")
+	return buf.String()
+}
+
+func (p *texParser) parseEnvironment() (string, int, error) {
+	name, err := p.rawArg()
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Column alignment for arrays
+	var align []string
+	if name == "array" {
+		spec, err := p.rawArg()
+		if err != nil {
+			return "", 0, err
+		}
+		for _, ch := range spec {
+			switch ch {
+			case 'l':
+				align = append(align, "left")
+			case 'c':
+				align = append(align, "center")
+			case 'r':
+				align = append(align, "right")
+			case '|', ' ':
+			default:
+				return "", 0, p.errorf("unsupported array column %q", ch)
+			}
+		}
+	}
+
+	rows, err := p.parseRows(name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if delims, ok := texMatrixDelims[name]; ok {
+		return "<mrow>" + fence(delims[0]) + mtable(rows, "") + fence(delims[1]) + "</mrow>", 0, nil
+	}
+
+	switch name {
+	case "array":
+		return mtable(rows, ` columnalign="`+strings.Join(align, " ")+`"`), 0, nil
+
+	case "cases":
+		return "<mrow>" + fence("{") + mtable(rows, ` columnalign="left left"`) + "</mrow>", 0, nil
+
+	case "aligned", "align", "align*", "split", "gathered", "gather", "gather*", "eqnarray", "eqnarray*":
+		// Alternating right/left alignment around the & points
+		cols := 0
+		for _, row := range rows {
+			if len(row) > cols {
+				cols = len(row)
+			}
+		}
+		align = nil
+		for i := 0; i < cols; i++ {
+			if strings.HasPrefix(name, "gather") {
+				align = append(align, "center")
+			} else if i%2 == 0 {
+				align = append(align, "right")
+			} else {
+				align = append(align, "left")
+			}
+		}
+		return mtable(rows, ` displaystyle="true" columnspacing="0em 2em" columnalign="`+strings.Join(align, " ")+`"`), 0, nil
+	}
+
+	return "", 0, p.errorf("unsupported environment %q", name)
+}
+
+// Converts TeX math to a MathML <math> element.
+func texToMathML(tex string, display bool) (string, error) {
+	p := &texParser{src: tex, display: display}
+	items, err := p.parseSeq()
+	if err != nil {
+		return "", err
+	}
+	if !p.eof() {
+		return "", p.errorf("unexpected %q", p.src[p.pos:min(p.pos+8, len(p.src))])
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML"`)
+	if display {
+		buf.WriteString(` display="block"`)
+	}
+	buf.WriteString("><semantics>")
+	buf.WriteString("<mrow>" + strings.Join(items, "") + "</mrow>")
+	buf.WriteString(`<annotation encoding="application/x-tex">`)
+	buf.WriteString(html.EscapeString(tex))
+	buf.WriteString("</annotation></semantics></math>")
+	return buf.String(), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The MathML for the formula itself, without the <math> wrapper and the TeX
+// annotation.
+func mathmlBody(t *testing.T, mathml string) string {
+	start := strings.Index(mathml, "<semantics>")
+	end := strings.Index(mathml, "<annotation")
+	if start == -1 || end == -1 {
+		t.Fatalf("unexpected MathML %q", mathml)
+	}
+	return mathml[start+len("<semantics>") : end]
+}
+
+func TestTexToMathML(t *testing.T) {
+	tests := []struct {
+		tex, want string
+	}{
+		{`x`, `<mrow><mi>x</mi></mrow>`},
+		{`12.5`, `<mrow><mn>12.5</mn></mrow>`},
+		{`x^2`, `<mrow><msup><mi>x</mi><mn>2</mn></msup></mrow>`},
+		{`x_i`, `<mrow><msub><mi>x</mi><mi>i</mi></msub></mrow>`},
+		{`x_i^2`, `<mrow><msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup></mrow>`},
+		{`\frac{a}{b}`, `<mrow><mfrac><mi>a</mi><mi>b</mi></mfrac></mrow>`},
+		{`\sqrt{x}`, `<mrow><msqrt><mi>x</mi></msqrt></mrow>`},
+		{`\alpha+\beta`, `<mrow><mi>α</mi><mo>+</mo><mi>β</mi></mrow>`},
+		{`a \le b`, `<mrow><mi>a</mi><mo>≤</mo><mi>b</mi></mrow>`},
+		{`\mathrm{d}x`, `<mrow><mi mathvariant="normal">d</mi><mi>x</mi></mrow>`},
+		{`\text{if } x`, `<mrow><mtext>if </mtext><mi>x</mi></mrow>`},
+		{`\left( x \right)`, `<mrow><mrow><mo fence="true" stretchy="true">(</mo><mi>x</mi><mo fence="true" stretchy="true">)</mo></mrow></mrow>`},
+		{`\sum_{i=1}^n i`, `<mrow><msubsup><mo largeop="true" movablelimits="true">∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></msubsup><mi>i</mi></mrow>`},
+		{`\begin{pmatrix}a & b\\ c & d\end{pmatrix}`, `<mrow><mrow><mo fence="true" stretchy="true">(</mo><mtable><mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr></mtable><mo fence="true" stretchy="true">)</mo></mrow></mrow>`},
+		{`\begin{aligned}a &= b\\ c &= d\end{aligned}`, `<mrow><mtable displaystyle="true" columnspacing="0em 2em" columnalign="right left"><mtr><mtd><mi>a</mi></mtd><mtd><mrow><mo>=</mo><mi>b</mi></mrow></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mrow><mo>=</mo><mi>d</mi></mrow></mtd></mtr></mtable></mrow>`},
+	}
+	for _, test := range tests {
+		got, err := texToMathML(test.tex, false)
+		if err != nil {
+			t.Errorf("%q: %s", test.tex, err.Error())
+			continue
+		}
+		if body := mathmlBody(t, got); body != test.want {
+			t.Errorf("%q:\n got %s\nwant %s", test.tex, body, test.want)
+		}
+	}
+}
+
+func TestTexToMathMLDisplay(t *testing.T) {
+	got, err := texToMathML(`\sum_{i=1}^n i`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, ` display="block"`) {
+		t.Errorf("display math without display=\"block\": %s", got)
+	}
+	// Limits go above and below in display mode.
+	want := `<mrow><munderover><mo largeop="true" movablelimits="true">∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></munderover><mi>i</mi></mrow>`
+	if body := mathmlBody(t, got); body != want {
+		t.Errorf("got %s\nwant %s", body, want)
+	}
+}
+
+func TestTexToMathMLErrors(t *testing.T) {
+	tests := []struct {
+		tex, want string
+	}{
+		{`\foo`, `unsupported command \foo`},
+		{`{x`, `expected '}'`},
+	}
+	for _, test := range tests {
+		_, err := texToMathML(test.tex, false)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %v, want one containing %q", test.tex, err, test.want)
+		}
+	}
+}
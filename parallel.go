@@ -0,0 +1,43 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Calls fn(i) for i in [0,n) using the given number of workers (0 means one
+// per CPU). All calls are made even if some fail; the error returned is
+// the one for the lowest i, so error reporting doesn't depend on
+// scheduling.
+func parallelFor(workers, n int, fn func(i int) error) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	workers = min(workers, n)
+
+	errs := make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Declares a custom post property in the site config.
+type ParamSpec struct {
+	Type     string      `json:"type"`     // see paramTypes; empty means any value
+	Default  interface{} `json:"default"`  // used when a post doesn't set the property
+	Required bool        `json:"required"` // if set, every post has to set the property
+}
+
+// Converters for the supported param types. Values can come from the dash
+// syntax (always strings), structured front matter or the JSON config.
+var paramTypes = map[string]func(value interface{}) (interface{}, error){
+	"":       func(value interface{}) (interface{}, error) { return value, nil },
+	"any":    func(value interface{}) (interface{}, error) { return value, nil },
+	"string": paramString,
+	"int":    paramInt,
+	"float":  paramFloat,
+	"bool":   paramBool,
+	"time":   paramTime,
+	"list":   paramList,
+	"map":    paramMap,
+}
+
+func paramString(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return nil, fmt.Errorf("expected a string, got %T", value)
+}
+
+func paramInt(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int(v), nil
+		}
+	case string:
+		if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return i, nil
+		}
+	}
+	return nil, fmt.Errorf("expected an integer, got %#v", value)
+}
+
+func paramFloat(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a number, got %#v", value)
+}
+
+func paramBool(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("expected true or false, got %#v", value)
+}
+
+func paramTime(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC(), nil
+	case string:
+		return parseTime(v)
+	}
+	return nil, fmt.Errorf("expected a time, got %T", value)
+}
+
+// Lists in the dash syntax are comma-separated.
+func paramList(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case string:
+		var list []interface{}
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("expected a list, got %T", value)
+}
+
+func paramMap(value interface{}) (interface{}, error) {
+	if m, ok := value.(map[string]interface{}); ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("expected a map, got %T", value)
+}
+
+// Checks the param schema in the site config.
+func (blog *Blog) validateParamSchema() error {
+	for _, name := range sortedSpecNames(blog.ParamSchema) {
+		spec := blog.ParamSchema[name]
+		key := "params." + name
+		if spec == nil {
+			return fmt.Errorf("key %q: empty declaration.", key)
+		}
+		if isBuiltinProperty(name) {
+			return fmt.Errorf("key %q: %q is a built-in property.", key, name)
+		}
+
+		conv, ok := paramTypes[spec.Type]
+		if !ok {
+			return fmt.Errorf("key %q: unknown type %q.", key, spec.Type)
+		}
+		if spec.Default != nil {
+			value, err := conv(spec.Default)
+			if err != nil {
+				return fmt.Errorf("key %q: bad default: %s", key, err.Error())
+			}
+			spec.Default = value
+		}
+	}
+	return nil
+}
+
+func sortedSpecNames(schema map[string]*ParamSpec) []string {
+	props := make(map[string]interface{}, len(schema))
+	for name := range schema {
+		props[name] = nil
+	}
+	return sortedKeys(props)
+}
+
+// Checks a post's custom properties against the param schema, converting
+// them to the declared types and filling in defaults. Without a schema,
+// any property is accepted as is.
+func (blog *Blog) applyParamSchema(post *Post) error {
+	if len(blog.ParamSchema) == 0 {
+		return nil
+	}
+
+	for _, name := range sortedKeys(post.Params) {
+		spec, ok := blog.ParamSchema[name]
+		if !ok {
+			return fmt.Errorf("%q: unknown property %q", post.Id, name)
+		}
+
+		value, err := paramTypes[spec.Type](post.Params[name])
+		if err != nil {
+			return fmt.Errorf("%q: property %q: %s", post.Id, name, err.Error())
+		}
+		post.Params[name] = value
+	}
+
+	for _, name := range sortedSpecNames(blog.ParamSchema) {
+		spec := blog.ParamSchema[name]
+		if _, ok := post.Params[name]; ok {
+			continue
+		}
+		if spec.Required {
+			return fmt.Errorf("%q: required property %q not set", post.Id, name)
+		}
+		if spec.Default != nil {
+			if post.Params == nil {
+				post.Params = make(map[string]interface{})
+			}
+			post.Params[name] = spec.Default
+		}
+	}
+	return nil
+}
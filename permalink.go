@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Permalinks are patterns like "/:year/:month/:slug/", expanded per post.
+// Patterns ending in a slash give directory-style URLs, written as
+// index.html in that directory.
+const defaultPermalink = "/p:id.html"
+
+var permalinkVar = regexp.MustCompile(`:[a-z]+`)
+
+// Checks that a permalink pattern only uses variables we know about, and
+// that it leads to a distinct file for every post.
+func validatePermalink(key, pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("key %q must start with \"/\", got %q.", key, pattern)
+	}
+	for _, v := range permalinkVar.FindAllString(pattern, -1) {
+		switch v {
+		case ":year", ":month", ":day", ":id", ":slug":
+		default:
+			return fmt.Errorf("key %q: unknown variable %q in %q.", key, v, pattern)
+		}
+	}
+	if !strings.Contains(pattern, ":id") && !strings.Contains(pattern, ":slug") {
+		return fmt.Errorf("key %q must contain :id or :slug, got %q.", key, pattern)
+	}
+	return nil
+}
+
+// Are any pages below the site root? If so, the same relative link doesn't
+// work everywhere, so links start from the site root instead.
+func (blog *Blog) nestedPermalinks() bool {
+	return strings.Contains(blog.Permalink[1:], "/") || strings.Contains(blog.PagePermalink[1:], "/")
+}
+
+// Path of the site root on the server, from Url.
+func (blog *Blog) basePath() string {
+	u, err := url.Parse(blog.Url)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// Link to a file in the output (relative to OutDir), usable on any page.
+// An empty dst links to the home page.
+func (blog *Blog) linkTo(dst string) string {
+	if !blog.nestedPermalinks() {
+		if dst == "" {
+			return indexPageName(1)
+		}
+		return dst
+	}
+	return blog.basePath() + "/" + dst
+}
+
+// Link to a file in the output, for use in templates, e.g. for stylesheets:
+// {{.Blog.Path "static/style.css"}}.
+func (blog *Blog) Path(dst string) string {
+	return blog.linkTo(dst)
+}
+
+// Link to a post from any page.
+func (blog *Blog) postLink(post *Post) string {
+	return blog.linkTo(post.urlPath)
+}
+
+// Slug for a post: the slug property if it has one, else derived from the
+// title, else the ID.
+func (post *Post) Slug() string {
+	if post.slug != "" {
+		return post.slug
+	}
+	if slug := slugify(post.Title); slug != "" {
+		return slug
+	}
+	return string(post.Id)
+}
+
+func expandPermalink(pattern string, post *Post) string {
+	return permalinkVar.ReplaceAllStringFunc(pattern, func(v string) string {
+		switch v {
+		case ":year":
+			return post.Published.Format("2006")
+		case ":month":
+			return post.Published.Format("01")
+		case ":day":
+			return post.Published.Format("02")
+		case ":id":
+			return string(post.Id)
+		case ":slug":
+			return post.Slug()
+		}
+		return v
+	})
+}
+
+// Output files the blog writes besides posts, with what they are. Posts
+// can't take their place.
+func (blog *Blog) generatedFiles() map[string]string {
+	files := map[string]string{
+		sitemapFile: "the sitemap",
+	}
+	if blog.writesRobots() {
+		files[robotsFile] = "robots.txt"
+	}
+	for page := 1; page <= blog.numIndexPages(); page++ {
+		files[indexPageName(page)] = fmt.Sprintf("home page %d", page)
+	}
+
+	feeds := []struct {
+		file, format string
+	}{
+		{blog.AtomFeedFile, "Atom"},
+		{blog.RssFeedFile, "RSS"},
+		{blog.JsonFeedFile, "JSON"},
+	}
+	for _, feed := range feeds {
+		if feed.file != "" {
+			files[feed.file] = "the " + feed.format + " feed"
+		}
+	}
+	for _, tag := range blog.Tags {
+		files[tag.FeedFile] = fmt.Sprintf("the feed for tag %q", tag.Name)
+	}
+	return files
+}
+
+// Works out where all posts go, and makes sure no two end up in the same
+// place. Runs once all posts (including generated ones) are known.
+func (blog *Blog) AssignPermalinks() error {
+	generated := blog.generatedFiles()
+	used := make(map[string]*Post)
+	for _, post := range blog.AllPosts {
+		if post.unpublished {
+			continue
+		}
+
+		pattern := blog.Permalink
+		if post.Type != DocPost {
+			pattern = blog.PagePermalink
+		}
+		link := strings.TrimPrefix(expandPermalink(pattern, post), "/")
+
+		post.urlPath = link
+		post.outputPath = link
+		if strings.HasSuffix(link, "/") {
+			post.outputPath = link + "index.html"
+			post.assetPath = strings.TrimSuffix(link, "/")
+		} else {
+			post.assetPath = string(post.Id)
+		}
+		post.Href = template.URL(blog.postLink(post))
+
+		if other := used[post.outputPath]; other != nil {
+			return fmt.Errorf("%q: permalink %q is already used by %q.", post.Id, "/"+link, other.Id)
+		}
+		if other, ok := generated[post.outputPath]; ok {
+			return fmt.Errorf("%q: permalink %q is already used by %s.", post.Id, "/"+link, other)
+		}
+		if path.Clean(post.outputPath) != post.outputPath || strings.HasPrefix(post.outputPath, "static/") {
+			return fmt.Errorf("%q: permalink %q isn't usable as a file name.", post.Id, "/"+link)
+		}
+		used[post.outputPath] = post
+	}
+	return blog.assignAliases(used, generated)
+}
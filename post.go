@@ -32,27 +32,57 @@ var docType = map[string]DocType{
 	"page":       DocPage,
 }
 
+func (t DocType) String() string {
+	for name, typ := range docType {
+		if typ == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("DocType(%d)", int(t))
+}
+
 type PostID string // Should be unique
 
 type Post struct {
-	Id        PostID
-	Type      DocType
-	Published time.Time
-	Updated   time.Time
-	Title     string
-	Content   template.HTML
-	Href      template.URL // permalink
-	Kids      []*Post      // for series
-	Parent    *Post        // for series
+	Id          PostID
+	Type        DocType
+	Published   time.Time
+	Updated     time.Time
+	Title       string
+	Content     template.HTML
+	FeedContent template.HTML          // Content as it goes into feeds, with absolute URLs
+	Summary     template.HTML          // teaser for the home page and feeds
+	SummaryText string                 // Summary as plain text
+	HasMore     bool                   // whether Content has more than Summary
+	Href        template.URL           // permalink
+	Kids        []*Post                // for series
+	Parent      *Post                  // for series
+	Toc         []*TocEntry            // for collections: the series as a tree
+	Params      map[string]interface{} // custom properties, for use by templates
+	Tags        []string
+	Aliases     []string // old paths that redirect here
 
 	// Flags for rendering
+	Draft     bool // not published unless building with drafts
+	NoIndex   bool // kept out of the sitemap and search engines
 	Active    bool
 	MathJax   bool
 	BlockCode bool
 
 	// Internals
-	parentId PostID
-	markdown []byte // actual markdown code
+	parentId    PostID
+	unpublished bool              // draft or scheduled, so not part of this build
+	markdown    []byte            // actual markdown code
+	header      []byte            // front matter and property lines, for the render cache
+	assets      map[string]string // uri -> source path of static files referenced by the post
+	mathErrors  []string          // why formulas couldn't be converted to MathML
+	summary     string            // markdown from the summary property
+	slug        string            // from the slug property
+	urlPath     string            // URL relative to the site root, from the permalink
+	outputPath  string            // file in OutDir
+	assetPath   string            // directory in OutDir for images
+	assetDir    string            // directory the post's images come from, see findPostFiles
+	feedSummary template.HTML     // Summary for feeds, like FeedContent
 }
 
 const (
@@ -74,7 +104,6 @@ func NewPost(id string, contents []byte) (*Post, error) {
 		return nil, err
 	}
 
-	post.Href = template.URL(post.RenderedName())
 	return post, nil
 }
 
@@ -86,90 +115,151 @@ func NewCollectionPost(root *Post) (out *Post, err error) {
 		Updated:   root.Updated,
 		Title:     root.Title,
 		Kids:      root.Kids,
+		Toc:       seriesToc(root.Kids, ""),
+		NoIndex:   root.NoIndex,
 	}
 
 	return
 }
 
+// Times without an offset are taken to be UTC. Times with one, as written
+// by the "new" command and by YAML and TOML front matter, are converted
+// to UTC.
 var timeFormats = []string{
 	"2006-01-02",
 	"2006-01-02 15:04",
 	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05 -07:00",
+	time.RFC3339,
 }
 
 func parseTime(value string) (time.Time, error) {
 	for _, fmt := range timeFormats {
 		if time, err := time.Parse(fmt, value); err == nil {
-			return time, nil
+			return time.UTC(), nil
 		}
 	}
 	return time.Time{}, fmt.Errorf("couldn't parse time %q", value)
 }
 
 func (post *Post) parseContent(contents []byte) error {
-	rest := contents
+	// Posts can start with a block of structured (YAML or TOML) front matter.
+	props, rest, err := parseFrontMatter(contents)
+	if err != nil {
+		return fmt.Errorf("%q: %s", post.Id, err.Error())
+	}
+	for _, key := range sortedKeys(props) {
+		if err := post.setProperty(key, props[key]); err != nil {
+			return err
+		}
+	}
 
 	// Lines at the beginning of the file that start with "-" denote property
 	// assignments, which are of the form "<key>=<value>".
-	for rest[0] == '-' {
-		var line string
-		var err error
-
-		eol := bytes.IndexByte(rest, '\n')
-		if eol != -1 {
-			line = string(rest[1:eol])
-			rest = rest[eol+1:]
-		} else {
-			line = string(rest)
-			rest = rest[len(rest):]
-		}
+	for len(rest) > 0 && rest[0] == '-' {
+		var line []byte
+		line, rest = splitLine(rest[1:])
 
-		// if this line was terminated by CRLF, strip the CR too
-		if len(line) > 0 && line[len(line)-1] == '\r' {
-			line = line[:len(line)-1]
-		}
-
-		key, value := parseKeyValueLine(line)
+		key, value := parseKeyValueLine(string(line))
 		if key == "" {
 			return fmt.Errorf("%q: configuration line %q ill-formed", post.Id, line)
 		}
 
-		switch key {
-		case "title":
-			post.Title = value
+		if err := post.setProperty(key, value); err != nil {
+			return err
+		}
+	}
+
+	if post.Updated.IsZero() {
+		post.Updated = post.Published
+	}
 
-		case "time":
-			if post.Published, err = parseTime(value); err != nil {
-				return fmt.Errorf("%q: %s", post.Id, err.Error())
-			}
+	post.header = contents[:len(contents)-len(rest)]
+	post.markdown = rest
 
-		case "updated":
-			if post.Updated, err = parseTime(value); err != nil {
-				return fmt.Errorf("%q: %s", post.Id, err.Error())
-			}
+	return post.validate()
+}
+
+// Sets a post property. Values are strings for the dash syntax, or whatever
+// the decoder produced for structured front matter.
+func (post *Post) setProperty(key string, value interface{}) (err error) {
+	// Most properties want a single string
+	str := func() (string, error) { return propertyString(key, value) }
+
+	var s string
+	switch key {
+	case "title":
+		post.Title, err = str()
+
+	case "time":
+		post.Published, err = propertyTime(key, value)
 
-		case "type":
+	case "updated":
+		post.Updated, err = propertyTime(key, value)
+
+	case "type":
+		if s, err = str(); err == nil {
 			var ok bool
-			post.Type, ok = docType[value]
-			if !ok {
-				return fmt.Errorf("%q: unknown type %q", post.Id, value)
+			if post.Type, ok = docType[s]; !ok {
+				err = fmt.Errorf("unknown type %q", s)
 			}
+		}
 
-		case "parent":
-			post.parentId = PostID(value)
+	case "parent":
+		s, err = str()
+		post.parentId = PostID(s)
 
-		default:
-			return fmt.Errorf("%q: unknown property %q", post.Id, key)
+	case "tags":
+		post.Tags, err = propertyStringList(key, value)
+
+	case "summary":
+		post.summary, err = str()
+
+	case "aliases":
+		post.Aliases, err = propertyStringList(key, value)
+
+	case "slug":
+		if s, err = str(); err == nil {
+			if post.slug = slugify(s); post.slug == "" {
+				err = fmt.Errorf("slug %q needs to contain at least one letter or digit", s)
+			}
 		}
-	}
 
-	if post.Updated.IsZero() {
-		post.Updated = post.Published
+	case "noindex":
+		var b interface{}
+		if b, err = paramBool(value); err == nil {
+			post.NoIndex = b.(bool)
+		}
+
+	case "draft":
+		var b interface{}
+		if b, err = paramBool(value); err == nil {
+			post.Draft = b.(bool)
+		}
+
+	default:
+		// Anything else is a custom property; the schema (if there is one)
+		// gets checked once the post is added to the blog.
+		if post.Params == nil {
+			post.Params = make(map[string]interface{})
+		}
+		post.Params[key] = value
 	}
 
-	post.markdown = rest
+	if err != nil {
+		return fmt.Errorf("%q: %s", post.Id, err.Error())
+	}
+	return nil
+}
 
-	return post.validate()
+// Is key handled by setProperty itself (as opposed to being a custom
+// property)?
+func isBuiltinProperty(key string) bool {
+	switch key {
+	case "title", "time", "updated", "type", "parent", "tags", "draft", "summary", "noindex", "slug", "aliases":
+		return true
+	}
+	return false
 }
 
 func (post *Post) validate() error {
@@ -202,36 +292,60 @@ func (post *Post) Standalone() bool {
 
 // Name of the renderer HTML file for this post
 func (post *Post) RenderedName() string {
-	return "p" + string(post.Id) + ".html"
+	return post.outputPath
 }
 
 // Name of the asset path for this post
 func (post *Post) AssetPath() string {
-	return string(post.Id)
+	return post.assetPath
+}
+
+// Directory with the post's own images. Generated posts don't have a file,
+// but can still have images in PostDir/<id>.
+func (post *Post) sourceAssetDir(blog *Blog) string {
+	if post.assetDir != "" {
+		return post.assetDir
+	}
+	return filepath.Join(blog.PostDir, string(post.Id))
 }
 
 func (post *Post) Render(blog *Blog) error {
+	post.assets = make(map[string]string)
 	renderer := newHtmlRenderer(post, blog)
-	post.Content = template.HTML(blackfriday.Markdown(post.markdown, renderer, extensions))
-	return renderer.err
+	html, err := renderer.render(post.markdown)
+	if err != nil {
+		return err
+	}
+	post.Content = template.HTML(html)
+
+	summary, more, err := post.renderSummary(blog, html, false)
+	if err != nil {
+		return err
+	}
+	post.Summary = template.HTML(summary)
+	post.SummaryText = htmlToText(summary)
+	post.HasMore = more
+	return nil
 }
 
-func tryAddImage(blog *Blog, post *Post, filepath, uri string) (found bool, err error, cfg image.Config) {
+func tryAddImage(blog *Blog, post *Post, filepath, uri string) (found bool, err error, cfg image.Config, format string) {
 	var file *os.File
 	found = false
 	if file, err = os.Open(filepath); err == nil {
-		cfg, _, err = image.DecodeConfig(file)
+		cfg, format, err = image.DecodeConfig(file)
 		file.Close()
 
 		if err == nil {
 			found = true
-			err = blog.AddStaticFile(uri, filepath)
+			if err = blog.AddStaticFile(uri, filepath); err == nil {
+				post.assets[uri] = filepath
+			}
 		}
 	}
 	return
 }
 
-func findImage(blog *Blog, post *Post, name string) (uri string, err error, cfg image.Config) {
+func findImage(blog *Blog, post *Post, name string) (uri string, err error, cfg image.Config, format string) {
 	// If it's an absolute URL, pass it through - but we don't know the size.
 	if url, urlerr := url.Parse(name); urlerr == nil && url.IsAbs() {
 		uri = name
@@ -244,22 +358,25 @@ func findImage(blog *Blog, post *Post, name string) (uri string, err error, cfg
 		return
 	}
 
-	// If the path name contains a slash, assume it's a full path
-	// in the content dir.
+	// If the path name contains a slash, it's either in a subdirectory of
+	// the post's asset dir, or a full path in the content dir.
 	if strings.IndexRune(name, '/') != -1 {
 		var found bool
-		filepath := filepath.Join(blog.PostDir, name)
+		uri = path.Join(post.AssetPath(), name)
+		if found, err, cfg, format = tryAddImage(blog, post, filepath.Join(post.sourceAssetDir(blog), name), uri); found {
+			return
+		}
 		uri = name
-		if found, err, cfg = tryAddImage(blog, post, filepath, uri); found {
+		if found, err, cfg, format = tryAddImage(blog, post, filepath.Join(blog.PostDir, name), uri); found {
 			return
 		}
 	} else {
 		// Search first in asset dirs for this post, then parent posts
 		for p := post; p != nil; p = p.Parent {
 			var found bool
-			filepath := filepath.Join(blog.PostDir, p.AssetPath(), name)
+			filepath := filepath.Join(p.sourceAssetDir(blog), name)
 			uri = path.Join(p.AssetPath(), name)
-			if found, err, cfg = tryAddImage(blog, post, filepath, uri); found {
+			if found, err, cfg, format = tryAddImage(blog, post, filepath, uri); found {
 				return
 			}
 
@@ -275,6 +392,10 @@ type postHtmlRenderer struct {
 	post *Post
 	blog *Blog
 	err  error
+	feed bool // rendering for feeds, see RenderFeed
+
+	shortcodeCalls []*shortcodeCall
+	shortcodeNonce string // see shortcodeMarker
 }
 
 func newHtmlRenderer(post *Post, blog *Blog) *postHtmlRenderer {
@@ -287,6 +408,14 @@ func newHtmlRenderer(post *Post, blog *Blog) *postHtmlRenderer {
 	}
 }
 
+func (p *postHtmlRenderer) render(markdown []byte) ([]byte, error) {
+	html := blackfriday.Markdown(markdown, p, extensions)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.expandShortcodes(html)
+}
+
 func (p *postHtmlRenderer) Error(err error) {
 	if p.err == nil {
 		p.err = err
@@ -297,11 +426,27 @@ func (p *postHtmlRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string
 	var args map[string]string
 
 	if lang != "" {
-		p.post.BlockCode = true
 		args = parseAttrs(lang)
 	}
 	out.WriteString("\n")
 
+	// Highlight at build time if we can. Line ranges we don't understand
+	// are passed on to the client as they are.
+	l := languages[strings.ToLower(args["@0"])]
+	if highlight, err := parseLineRanges(args["highlight"], bytes.Count(text, []byte("\n"))+1); l != nil && err == nil && p.blog.Highlight != "client" {
+		out.WriteString("<pre class=\"language-")
+		out.WriteString(html.EscapeString(args["@0"]))
+		out.WriteString("\"><code>")
+		highlightCode(out, l, string(text), highlight)
+		out.WriteString("</code></pre>\n")
+		return
+	}
+
+	// Otherwise, leave it to the client
+	if lang != "" {
+		p.post.BlockCode = true
+	}
+
 	// parse out the language names/classes
 	out.WriteString("<pre")
 	if lang, ok := args["@0"]; ok {
@@ -320,26 +465,59 @@ func (p *postHtmlRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string
 }
 
 func (p *postHtmlRenderer) Image(out *bytes.Buffer, link, title, alt []byte) {
-	uri, err, cfg := findImage(p.blog, p.post, string(link))
+	uri, err, cfg, format := findImage(p.blog, p.post, string(link))
 	if err != nil {
 		p.Error(err)
 		return
 	}
 
+	// Local images are output files, which need links that work from any
+	// page; absolute URLs stay as they are.
+	_, local := p.post.assets[uri]
+	href := func(uri string) string {
+		if local {
+			return p.blog.linkTo(uri)
+		}
+		return uri
+	}
+
+	// Local images get downscaled versions for browsers to pick from
+	var variants []imageVariant
+	if src, ok := p.post.assets[uri]; ok && cfg.Width > 0 {
+		if variants, err = p.blog.imageVariants(p.post, uri, src, cfg, format); err != nil {
+			p.Error(err)
+			return
+		}
+	}
+
+	srcset := ""
+	if len(variants) > 0 && !p.feed {
+		for _, v := range variants {
+			srcset += fmt.Sprintf("%s %dw, ", href(v.uri), v.width)
+		}
+		srcset += fmt.Sprintf("%s %dw", href(uri), cfg.Width)
+	}
+
 	resized := false
+	fullUri := uri
 	if cfg.Width > p.blog.MaxImageWidth {
-		// Image is wider than maximum, specify smaller size
+		// Image is wider than maximum, show the thumbnail
 		// and insert a link to the full-size version
 		out.WriteString("<a href=\"")
-		out.WriteString(uri)
+		out.WriteString(html.EscapeString(href(fullUri)))
 		out.WriteString("\">")
 		if len(title) == 0 {
 			title = []byte("Click for full-size version.")
 		}
 
 		// Figure out new size (aspect-ratio preserving)
-		cfg.Height = int((int64(cfg.Height)*int64(p.blog.MaxImageWidth) + int64(cfg.Width/2)) / int64(cfg.Width))
+		cfg.Height = scaledHeight(cfg, p.blog.MaxImageWidth)
 		cfg.Width = p.blog.MaxImageWidth
+		for _, v := range variants {
+			if v.width == cfg.Width {
+				uri = v.uri
+			}
+		}
 
 		resized = true
 	}
@@ -356,7 +534,7 @@ func (p *postHtmlRenderer) Image(out *bytes.Buffer, link, title, alt []byte) {
 	title = handleMarkdownEscapes(title)
 
 	out.WriteString("<img src=\"")
-	out.WriteString(html.EscapeString(uri))
+	out.WriteString(html.EscapeString(href(uri)))
 	out.WriteString("\" alt=\"")
 	out.WriteString(html.EscapeString(string(alt)))
 	if len(title) > 0 {
@@ -364,7 +542,15 @@ func (p *postHtmlRenderer) Image(out *bytes.Buffer, link, title, alt []byte) {
 		out.WriteString(html.EscapeString(string(title)))
 	}
 	out.WriteByte('"')
-	if cfg.Width > 0 && cfg.Height > 0 {
+	if srcset != "" {
+		out.WriteString(" srcset=\"")
+		out.WriteString(html.EscapeString(srcset))
+		fmt.Fprintf(out, "\" sizes=\"(max-width: %dpx) 100vw, %dpx\"", cfg.Width, cfg.Width)
+	}
+	if cfg.Width > 0 && cfg.Height > 0 && p.feed {
+		// Feed readers don't get our stylesheet
+		fmt.Fprintf(out, " width=\"%d\" height=\"%d\" style=\"max-width: 100%%; height: auto;\"", cfg.Width, cfg.Height)
+	} else if cfg.Width > 0 && cfg.Height > 0 {
 		out.WriteString(" width=")
 		out.WriteString(strconv.Itoa(cfg.Width))
 		out.WriteString(" height=")
@@ -391,7 +577,10 @@ func (p *postHtmlRenderer) Link(out *bytes.Buffer, link, title, content []byte)
 		}
 
 		if target := p.blog.FindPostById(linkTo); target != nil {
-			link = append([]byte(target.RenderedName()), fragment...)
+			if target.unpublished {
+				p.Error(fmt.Errorf("%q: contains link to post %q which is not published.", p.post.Id, linkTo))
+			}
+			link = append([]byte(p.blog.postLink(target)), fragment...)
 			if string(content) == "%" {
 				content = []byte(target.Title)
 			}
@@ -405,7 +594,41 @@ func (p *postHtmlRenderer) Link(out *bytes.Buffer, link, title, content []byte)
 	p.Html.Link(out, link, title, content)
 }
 
+// Converts math to MathML if we can; if not, remembers why and returns
+// false, so the caller falls back to MathJax.
+func (p *postHtmlRenderer) mathML(out *bytes.Buffer, text []byte, display bool) bool {
+	if p.blog.Math != "mathml" && !p.feed {
+		return false
+	}
+
+	mathml, err := texToMathML(string(text), display)
+	if err != nil && p.feed {
+		// Feed readers don't run scripts, so show the source.
+		out.WriteString("<code>")
+		out.WriteString(html.EscapeString(string(text)))
+		out.WriteString("</code>")
+		return true
+	}
+	if err != nil {
+		// The summary is rendered on its own, and often repeats formulas
+		// from the body; report each problem once.
+		msg := fmt.Sprintf("%q: %s", text, err.Error())
+		for _, other := range p.post.mathErrors {
+			if other == msg {
+				return false
+			}
+		}
+		p.post.mathErrors = append(p.post.mathErrors, msg)
+		return false
+	}
+	out.WriteString(mathml)
+	return true
+}
+
 func (p *postHtmlRenderer) DisplayMath(out *bytes.Buffer, text []byte) {
+	if p.mathML(out, text, true) {
+		return
+	}
 	p.post.MathJax = true
 	out.WriteString("<script type=\"math/tex; mode=display\">")
 	out.Write(text)
@@ -415,6 +638,9 @@ func (p *postHtmlRenderer) DisplayMath(out *bytes.Buffer, text []byte) {
 }
 
 func (p *postHtmlRenderer) InlineMath(out *bytes.Buffer, text []byte) {
+	if p.mathML(out, text, false) {
+		return
+	}
 	p.post.MathJax = true
 	out.WriteString("<script type=\"math/tex\">")
 	out.Write(text)
@@ -423,22 +649,6 @@ func (p *postHtmlRenderer) InlineMath(out *bytes.Buffer, text []byte) {
 	out.WriteString("</noscript>")
 }
 
-func (p *postHtmlRenderer) LiquidTag(out *bytes.Buffer, tag, content []byte) {
-	switch string(tag) {
-	case "figure":
-		out.WriteString("<figure>")
-	case "endfigure":
-		out.WriteString("</figure>")
-	case "figcaption":
-		out.WriteString("<figcaption>")
-	case "endfigcaption":
-		out.WriteString("</figcaption>")
-
-	default:
-		p.Error(fmt.Errorf("Unrecognized liquid-tag %q", string(tag)))
-	}
-}
-
 func parsePostLink(link []byte) PostID {
 	if len(link) < 2 || link[0] != '*' {
 		return ""
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Posts can list old URLs in their "aliases" property. Every alias gets a
+// small HTML page redirecting to the post, and optionally an entry in
+// redirect map files for web servers and hosts that support them.
+
+// A redirect from an old path to a post.
+type redirect struct {
+	from string // old path, relative to the site root
+	file string // where the redirect page goes
+	post *Post
+}
+
+// Redirect map formats, by name in the redirect_maps config key.
+var redirectMaps = map[string]struct {
+	file  string
+	entry func(from, to string) string
+}{
+	"netlify": {"_redirects", func(from, to string) string {
+		return fmt.Sprintf("%s %s 301\n", from, to)
+	}},
+	"apache": {".htaccess", func(from, to string) string {
+		// Plain Redirect matches prefixes, which would catch too much.
+		return fmt.Sprintf("RedirectMatch 301 ^%s$ %s\n", regexp.QuoteMeta(from), to)
+	}},
+	"nginx": {"redirects.nginx.conf", func(from, to string) string {
+		return fmt.Sprintf("location = %s { return 301 %s; }\n", from, to)
+	}},
+}
+
+// Cleans up an alias path (relative to the site root) and works out the
+// file its redirect page goes in. Paths without an extension are
+// directories.
+func parseAlias(alias string) (from, file string, err error) {
+	clean := strings.TrimPrefix(path.Clean("/"+alias), "/")
+	if clean == "" || strings.Contains(alias, "..") || strings.HasPrefix(clean, "static/") {
+		return "", "", fmt.Errorf("alias %q isn't a usable path", alias)
+	}
+	if strings.HasSuffix(alias, "/") {
+		return clean + "/", clean + "/index.html", nil
+	}
+	if path.Ext(clean) == "" {
+		return clean, clean + "/index.html", nil
+	}
+	return clean, clean, nil
+}
+
+// Works out where the redirect pages go. used maps the output paths taken
+// by posts to the posts, and generated the other files the blog writes to
+// what they are; aliases can't clash with any of those or each other.
+func (blog *Blog) assignAliases(used map[string]*Post, generated map[string]string) error {
+	for dst := range blog.files {
+		generated[dst] = fmt.Sprintf("static file %q", dst)
+	}
+	for _, name := range blog.RedirectMaps {
+		generated[redirectMaps[name].file] = "the " + name + " redirect map"
+	}
+
+	blog.redirects = nil
+	for _, post := range blog.AllPosts {
+		if post.unpublished {
+			continue
+		}
+		for _, alias := range post.Aliases {
+			from, file, err := parseAlias(alias)
+			if err != nil {
+				return fmt.Errorf("%q: %s.", post.Id, err.Error())
+			}
+			other := used[file]
+			if other == post {
+				// Same as the post's own permalink (e.g. after an import
+				// that kept the old URLs), so there's nothing to redirect.
+				continue
+			}
+			if other != nil {
+				return fmt.Errorf("%q: alias %q clashes with post %q.", post.Id, alias, other.Id)
+			}
+			if what, ok := generated[file]; ok {
+				return fmt.Errorf("%q: alias %q clashes with %s.", post.Id, alias, what)
+			}
+			used[file] = post
+			blog.redirects = append(blog.redirects, redirect{from, file, post})
+		}
+	}
+	return nil
+}
+
+// Makes sure no redirect page would overwrite a post's image. Those are only
+// known once the posts are rendered.
+func (blog *Blog) checkRedirectAssets() error {
+	for _, r := range blog.redirects {
+		if src, ok := blog.files[r.file]; ok {
+			return fmt.Errorf("%q: alias %q clashes with image %q.", r.post.Id, "/"+r.from, src)
+		}
+	}
+	return nil
+}
+
+// Writes the redirect pages and map files.
+func (blog *Blog) writeRedirects() error {
+	for _, r := range blog.redirects {
+		target := html.EscapeString(blog.postUrl(r.post))
+		page := fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<link rel="canonical" href="%s">
+<meta name="robots" content="noindex">
+<meta http-equiv="refresh" content="0; url=%s">
+</head>
+<body>
+<p>This page has moved to <a href="%s">%s</a>.</p>
+</body>
+</html>
+`, html.EscapeString(r.post.Title), target, target, target, target)
+		if err := blog.writeOutputFile(r.file, []byte(page)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range blog.RedirectMaps {
+		format := redirectMaps[name]
+
+		// Sorted by old path, so the files don't change needlessly.
+		lines := make([]string, 0, len(blog.redirects))
+		for _, r := range blog.redirects {
+			from := blog.basePath() + "/" + r.from
+			to := blog.basePath() + "/" + r.post.urlPath
+			lines = append(lines, format.entry(from, to))
+		}
+		sort.Strings(lines)
+
+		var buf bytes.Buffer
+		for _, line := range lines {
+			buf.WriteString(line)
+		}
+		if err := blog.writeOutputFile(format.file, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
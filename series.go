@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+)
+
+// Posts form series through their parent property. A series can have
+// parts with parts of their own; the whole tree, from a top-level root
+// down, becomes one collection.
+
+// An entry in the table of contents of a collection.
+type TocEntry struct {
+	Post   *Post
+	Number string // position in the tree, like "2.1"
+	Kids   []*TocEntry
+}
+
+// Makes sure following parents always ends at a series root. Run after
+// LinkPosts has set them, and before anything walks up the tree.
+func checkParentCycles(posts []*Post) error {
+	for _, post := range posts {
+		seen := make(map[*Post]bool)
+		for p := post; p != nil; p = p.Parent {
+			if !seen[p] {
+				seen[p] = true
+				continue
+			}
+
+			// Report the loop itself, starting where it closes.
+			chain := []string{string(p.Id)}
+			for q := p.Parent; q != p; q = q.Parent {
+				chain = append(chain, string(q.Id))
+			}
+			chain = append(chain, string(p.Id))
+			return fmt.Errorf("%q: parents form a cycle: %s.", p.Id, strings.Join(chain, " -> "))
+		}
+	}
+	return nil
+}
+
+// Sorts the parts of every series by date, oldest first.
+func sortSeries(posts []*Post) {
+	for _, post := range posts {
+		sort.Sort(postsByPublishDateAsc(post.Kids))
+	}
+}
+
+// How deep in its series a post is: 0 for posts without a parent, 1 for
+// parts of a series, 2 for their parts and so on.
+func (post *Post) Depth() int {
+	depth := 0
+	for p := post.Parent; p != nil; p = p.Parent {
+		depth++
+	}
+	return depth
+}
+
+// ID for the element holding the post on collection pages, which the table
+// of contents links to: <article id="{{.Anchor}}">.
+func (post *Post) Anchor() string {
+	return "part-" + strings.Join(strings.Fields(string(post.Id)), "-")
+}
+
+// All parts of a series, depth first: each part is followed by its own
+// parts.
+func seriesDocs(kids []*Post) []*Post {
+	var docs []*Post
+	for _, kid := range kids {
+		docs = append(docs, kid)
+		docs = append(docs, seriesDocs(kid.Kids)...)
+	}
+	return docs
+}
+
+func seriesToc(kids []*Post, prefix string) []*TocEntry {
+	var toc []*TocEntry
+	for i, kid := range kids {
+		number := fmt.Sprintf("%s%d", prefix, i+1)
+		toc = append(toc, &TocEntry{
+			Post:   kid,
+			Number: number,
+			Kids:   seriesToc(kid.Kids, number+"."),
+		})
+	}
+	return toc
+}
+
+// The table of contents of a collection as nested lists, for templates that
+// don't need to lay it out themselves.
+func (post *Post) TableOfContents() template.HTML {
+	var buf bytes.Buffer
+	writeToc(&buf, post.Toc)
+	return template.HTML(buf.String())
+}
+
+func writeToc(buf *bytes.Buffer, toc []*TocEntry) {
+	if len(toc) == 0 {
+		return
+	}
+	buf.WriteString("<ol class=\"toc\">\n")
+	for _, entry := range toc {
+		fmt.Fprintf(buf, "<li><a href=\"#%s\">%s</a>", template.HTMLEscapeString(entry.Post.Anchor()), template.HTMLEscapeString(entry.Post.Title))
+		if len(entry.Kids) > 0 {
+			buf.WriteString("\n")
+			writeToc(buf, entry.Kids)
+		}
+		buf.WriteString("</li>\n")
+	}
+	buf.WriteString("</ol>\n")
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the preview server checks the site for changes.
+const watchInterval = 500 * time.Millisecond
+
+// URL path of the server-sent event stream used for reload notifications.
+const reloadEventPath = "/_block/events"
+
+// Injected into every HTML page served by the preview server. Reloads the
+// page whenever the server reports a finished build.
+const reloadScript = `<script>
+(function() {
+	var source = new EventSource("` + reloadEventPath + `");
+	source.onmessage = function(e) { if (e.data === "reload") location.reload(); };
+})();
+</script>
+`
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Build failed</title>
+<style>
+body { margin: 0; background: #2b2b2b; color: #eee; font-family: sans-serif; }
+div { margin: 2em auto; max-width: 60em; padding: 1em 2em; background: #a33; border-radius: 4px; }
+pre { white-space: pre-wrap; font-size: 120%; }
+</style>
+</head>
+<body>
+<div>
+<h1>Build failed</h1>
+<pre>{{.}}</pre>
+<p>Fix the problem and save; this page reloads automatically.</p>
+</div>
+</body>
+</html>
+`))
+
+// Size and modification time of a watched file.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+type previewServer struct {
+	mu       sync.Mutex
+	outDir   string
+	basePath string // where links expect the site root, if not "/"
+	buildErr error
+	watched  []string               // files and directories to watch
+	stamps   map[string]fileStamp   // state of watched files at last build
+	clients  map[chan struct{}]bool // connected event streams
+
+	// Command line settings to carry over into rebuilds
+	includeDrafts bool
+	includeFuture bool
+}
+
+func runServe(blog *Blog, args []string) error {
+	flags := newFlagSet(findCommand("serve"))
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+	addPublishFlags(flags, blog)
+	flags.Parse(args)
+
+	srv := &previewServer{
+		clients:       make(map[chan struct{}]bool),
+		includeDrafts: blog.IncludeDrafts,
+		includeFuture: blog.IncludeFuture,
+	}
+	srv.build(blog)
+	go srv.watch()
+
+	http.HandleFunc(reloadEventPath, srv.serveEvents)
+	http.HandleFunc("/", srv.serveFile)
+
+	fmt.Printf("Serving on http://%s/\n", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
+
+// Builds the site and records the outcome. Errors are reported to the
+// browser instead of terminating the server.
+func (srv *previewServer) build(blog *Blog) {
+	start := time.Now()
+
+	// Snapshot before building so changes made during the build trigger
+	// another one.
+	watched := []string{configFileName, blog.PostDir, blog.TemplateDir}
+	stamps := snapshotFiles(watched)
+
+	err := buildSite(blog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+	} else {
+		fmt.Printf("Built in %v.\n", time.Since(start))
+	}
+
+	srv.mu.Lock()
+	srv.outDir = blog.OutDir
+	srv.basePath = ""
+	if blog.nestedPermalinks() {
+		srv.basePath = blog.basePath()
+	}
+	srv.buildErr = err
+	srv.watched = watched
+	srv.stamps = stamps
+	srv.mu.Unlock()
+}
+
+// Runs the whole pipeline, turning panics into errors so that a broken post
+// can't take down the server.
+func buildSite(blog *Blog) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("internal error: %v", r)
+		}
+	}()
+
+	if err = blog.Load(); err != nil {
+		return
+	}
+	return blog.WriteOutput()
+}
+
+// Rebuilds the site whenever a watched file changes, then tells all
+// connected browsers to reload.
+func (srv *previewServer) watch() {
+	for {
+		time.Sleep(watchInterval)
+
+		srv.mu.Lock()
+		watched, stamps := srv.watched, srv.stamps
+		srv.mu.Unlock()
+
+		if sameStamps(stamps, snapshotFiles(watched)) {
+			continue
+		}
+
+		// Start from scratch, the config might have changed too.
+		blog := NewBlog()
+		blog.IncludeDrafts = srv.includeDrafts
+		blog.IncludeFuture = srv.includeFuture
+		if err := blog.LoadConfig(configFileName); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			srv.mu.Lock()
+			srv.buildErr = err
+			srv.stamps = snapshotFiles(watched)
+			srv.mu.Unlock()
+		} else {
+			srv.build(blog)
+		}
+		srv.notify()
+	}
+}
+
+func (srv *previewServer) notify() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for ch := range srv.clients {
+		// Clients that already have a reload pending don't need another.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Serves the stream of reload events.
+func (srv *previewServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan struct{}, 1)
+	srv.mu.Lock()
+	srv.clients[ch] = true
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.clients, ch)
+		srv.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-ch:
+			fmt.Fprint(w, "data: reload\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Serves files from the output directory. HTML pages get the reload script
+// injected; if the last build failed, all pages show the error instead.
+func (srv *previewServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	outDir, basePath, buildErr := srv.outDir, srv.basePath, srv.buildErr
+	srv.mu.Unlock()
+
+	// Links start at the path of the site's URL, so serve it there.
+	if basePath != "" {
+		rest := strings.TrimPrefix(r.URL.Path, basePath)
+		switch {
+		case rest != r.URL.Path && (rest == "" || rest[0] == '/'):
+			r2 := *r
+			u := *r.URL
+			u.Path = "/" + strings.TrimPrefix(rest, "/")
+			r2.URL = &u
+			r = &r2
+		case r.URL.Path == "/":
+			http.Redirect(w, r, basePath+"/", http.StatusFound)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+	isHtml := path.Ext(name) == ".html"
+
+	if buildErr != nil && isHtml {
+		var buf bytes.Buffer
+		errorPage.Execute(&buf, buildErr.Error())
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(injectReloadScript(buf.Bytes()))
+		return
+	}
+
+	if !isHtml {
+		http.FileServer(http.Dir(outDir)).ServeHTTP(w, r)
+		return
+	}
+
+	file, err := http.Dir(outDir).Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	text, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(injectReloadScript(text))
+}
+
+// Inserts the reload script right before the closing body tag, or at the
+// end if there is none.
+func injectReloadScript(page []byte) []byte {
+	out := make([]byte, 0, len(page)+len(reloadScript))
+	if idx := bytes.LastIndex(page, []byte("</body>")); idx != -1 {
+		out = append(out, page[:idx]...)
+		out = append(out, reloadScript...)
+		return append(out, page[idx:]...)
+	}
+	out = append(out, page...)
+	return append(out, reloadScript...)
+}
+
+// Records size and modification times of all files under the given paths.
+func snapshotFiles(roots []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				stamps[path] = fileStamp{info.Size(), info.ModTime()}
+			}
+			return nil
+		})
+	}
+	return stamps
+}
+
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, sa := range a {
+		if sb, ok := b[path]; !ok || sa.size != sb.size || !sa.modTime.Equal(sb.modTime) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Shortcodes are liquid tags like {% note kind=warning %}. A shortcode can
+// enclose markdown by adding a matching end tag, {% endnote %}; otherwise
+// it stands on its own. They're defined either in Go (the shortcodes map
+// below) or as templates in TemplateDir/shortcodes/<name>.html, which take
+// precedence.
+
+// What a shortcode gets to work with. Templates see this as ".".
+type ShortcodeArgs struct {
+	Name    string
+	Args    map[string]string // from parseAttrs; positional arguments are "@0", "@1", ...
+	Content template.HTML     // rendered markdown between the tag and its end tag, if any
+	Post    *Post
+	Blog    *Blog
+}
+
+type shortcodeFunc func(out *bytes.Buffer, args *ShortcodeArgs) error
+
+// Shortcodes defined in Go.
+var shortcodes = map[string]shortcodeFunc{
+	"figure":     wrapShortcode("figure"),
+	"figcaption": wrapShortcode("figcaption"),
+}
+
+// A shortcode that wraps its content in an HTML element.
+func wrapShortcode(elem string) shortcodeFunc {
+	return func(out *bytes.Buffer, args *ShortcodeArgs) error {
+		fmt.Fprintf(out, "<%s>%s</%s>", elem, args.Content, elem)
+		return nil
+	}
+}
+
+func templateShortcode(tmpl *template.Template) shortcodeFunc {
+	return func(out *bytes.Buffer, args *ShortcodeArgs) error {
+		return tmpl.Execute(out, args)
+	}
+}
+
+// Sets up the shortcode registry: the built-in ones, plus the templates in
+// TemplateDir/shortcodes.
+func (blog *Blog) LoadShortcodes() error {
+	blog.shortcodes = make(map[string]shortcodeFunc)
+	for name, fn := range shortcodes {
+		blog.shortcodes[name] = fn
+	}
+
+	files, err := filepath.Glob(filepath.Join(blog.TemplateDir, "shortcodes", "*.html"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	// Cached renders need to be invalidated when the templates change.
+	var sources [][]byte
+	for _, file := range files {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		if strings.HasPrefix(name, "end") {
+			return fmt.Errorf("%s: shortcode names can't start with \"end\".", file)
+		}
+
+		tmpl, err := template.New(name).Parse(string(text))
+		if err != nil {
+			return err
+		}
+		blog.shortcodes[name] = templateShortcode(tmpl)
+		sources = append(sources, []byte(name), text)
+	}
+	blog.shortcodeKey = hashBytes(sources...)
+	return nil
+}
+
+// A shortcode tag seen while rendering a post.
+type shortcodeCall struct {
+	name string
+	end  bool
+	args map[string]string
+}
+
+// Shortcodes can enclose arbitrary markdown, which blackfriday renders
+// between our LiquidTag calls, so we can't expand them right away. Instead
+// the tags turn into markers, and expandShortcodes replaces them once the
+// whole post is rendered. Markers carry a nonce that's new for every
+// render, so comments in raw HTML can't pass for them.
+var shortcodeMarker = regexp.MustCompile(`<!--(/?)shortcode:([0-9a-f]+):(\d+)-->`)
+
+// Tags on a line of their own end up in a paragraph by themselves.
+var shortcodeParagraph = regexp.MustCompile(`<p>(<!--/?shortcode:([0-9a-f]+):\d+-->)</p>\n?`)
+
+func newShortcodeNonce() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func (p *postHtmlRenderer) LiquidTag(out *bytes.Buffer, tag, content []byte) {
+	name := string(tag)
+	call := &shortcodeCall{name: name}
+	if strings.HasPrefix(name, "end") {
+		call.name, call.end = name[3:], true
+	} else {
+		call.args = parseAttrs(string(content))
+	}
+
+	if p.blog.shortcodes[call.name] == nil {
+		p.Error(fmt.Errorf("%q: unrecognized liquid-tag %q.", p.post.Id, name))
+		return
+	}
+
+	slash := ""
+	if call.end {
+		slash = "/"
+	}
+	if p.shortcodeNonce == "" {
+		nonce, err := newShortcodeNonce()
+		if err != nil {
+			p.Error(fmt.Errorf("%q: %s", p.post.Id, err.Error()))
+			return
+		}
+		p.shortcodeNonce = nonce
+	}
+	fmt.Fprintf(out, "<!--%sshortcode:%s:%d-->", slash, p.shortcodeNonce, len(p.shortcodeCalls))
+	p.shortcodeCalls = append(p.shortcodeCalls, call)
+}
+
+// Replaces the shortcode markers in a rendered post with the shortcodes'
+// output.
+func (p *postHtmlRenderer) expandShortcodes(html []byte) ([]byte, error) {
+	if len(p.shortcodeCalls) == 0 {
+		return html, nil
+	}
+
+	html = shortcodeParagraph.ReplaceAllFunc(html, func(m []byte) []byte {
+		if sub := shortcodeParagraph.FindSubmatch(m); string(sub[2]) == p.shortcodeNonce {
+			return sub[1]
+		}
+		return m
+	})
+
+	// Open shortcodes, each with the output that follows it so far. The
+	// bottom entry is the post itself.
+	type frame struct {
+		call *shortcodeCall
+		buf  bytes.Buffer
+	}
+	stack := []*frame{{}}
+
+	// Expands the shortcode on top of the stack. Unless it has an end tag,
+	// what follows it isn't its content.
+	pop := func(enclosing bool) error {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		parent := &stack[len(stack)-1].buf
+
+		args := &ShortcodeArgs{
+			Name: top.call.name,
+			Args: top.call.args,
+			Post: p.post,
+			Blog: p.blog,
+		}
+		if enclosing {
+			args.Content = template.HTML(top.buf.String())
+		}
+		if err := p.blog.shortcodes[top.call.name](parent, args); err != nil {
+			return fmt.Errorf("%q: shortcode %q: %s", p.post.Id, top.call.name, err.Error())
+		}
+		if !enclosing {
+			parent.Write(top.buf.Bytes())
+		}
+		return nil
+	}
+
+	last := 0
+	for _, loc := range shortcodeMarker.FindAllSubmatchIndex(html, -1) {
+		// Anything that isn't one of our markers stays as it is.
+		index, err := strconv.Atoi(string(html[loc[6]:loc[7]]))
+		if string(html[loc[4]:loc[5]]) != p.shortcodeNonce || err != nil || index >= len(p.shortcodeCalls) {
+			continue
+		}
+		stack[len(stack)-1].buf.Write(html[last:loc[0]])
+		last = loc[1]
+
+		call := p.shortcodeCalls[index]
+		if !call.end {
+			stack = append(stack, &frame{call: call})
+			continue
+		}
+
+		// Shortcodes opened since the matching start tag stand on their own.
+		open := len(stack) - 1
+		for open > 0 && stack[open].call.name != call.name {
+			open--
+		}
+		if open == 0 {
+			return nil, fmt.Errorf("%q: {%% end%s %%} without matching {%% %s %%}.", p.post.Id, call.name, call.name)
+		}
+		for len(stack)-1 > open {
+			if err := pop(false); err != nil {
+				return nil, err
+			}
+		}
+		if err := pop(true); err != nil {
+			return nil, err
+		}
+	}
+	stack[len(stack)-1].buf.Write(html[last:])
+
+	for len(stack) > 1 {
+		if err := pop(false); err != nil {
+			return nil, err
+		}
+	}
+	return stack[0].buf.Bytes(), nil
+}
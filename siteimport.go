@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Jekyll and Hugo sites are both markdown files with front matter, so
+// importing them works much the same way. The differences (where posts
+// live, what their URLs were and which template tags they use) are up to
+// the importers in jekyll.go and hugo.go.
+
+// A Jekyll or Hugo import in progress.
+type siteImport struct {
+	blog       *Blog
+	contentDir string   // source files are relative to this
+	staticDir  string   // files at site-root paths come from here
+	baseUrl    *url.URL // URL of the old site, if known
+	posts      []*sitePost
+	lookup     map[string]*sitePost // see addKey
+	ignore     map[string]bool      // front matter keys not worth mentioning
+	unknown    map[string]int       // front matter keys not converted -> number of posts
+	warnings   []string
+}
+
+// A post being imported.
+type sitePost struct {
+	importedPost
+	file      string // source file, relative to contentDir, slash separated
+	bundle    string // directory whose files go along with the post, if any
+	oldUrl    string // path on the old site, without the base path
+	props     map[string]interface{}
+	text      string
+	published time.Time // wall clock time on the old site
+}
+
+func newSiteImport(blog *Blog, contentDir, staticDir, baseUrl string) *siteImport {
+	si := &siteImport{
+		blog:       blog,
+		contentDir: contentDir,
+		staticDir:  staticDir,
+		lookup:     make(map[string]*sitePost),
+		ignore:     make(map[string]bool),
+		unknown:    make(map[string]int),
+	}
+	if u, err := url.Parse(baseUrl); err == nil && baseUrl != "" {
+		si.baseUrl = u
+	}
+	return si
+}
+
+func (si *siteImport) warnf(file string, msg string, args ...interface{}) {
+	si.warnings = append(si.warnings, file+": "+fmt.Sprintf(msg, args...))
+}
+
+// Reads a source file, splitting off its front matter.
+func (si *siteImport) readPost(file string) (*sitePost, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(si.contentDir, filepath.FromSlash(file)))
+	if err != nil {
+		return nil, err
+	}
+	props, rest, err := parseFrontMatter(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+
+	// Keys are case-insensitive in Hugo, and Jekyll sites use lower case
+	// anyway.
+	sp := &sitePost{file: file, props: make(map[string]interface{}), text: string(rest)}
+	for key, value := range props {
+		sp.props[strings.ToLower(key)] = value
+	}
+	return sp, nil
+}
+
+// Adds a post under the given ID, or a variation of it if that's taken.
+func (si *siteImport) addPost(sp *sitePost, id string) {
+	if !validPostId(id) {
+		id = slugify(id)
+	}
+	if id == "" {
+		id = "post"
+	}
+	taken := func(id string) bool {
+		for _, other := range si.posts {
+			if other.id == id {
+				return true
+			}
+		}
+		return false
+	}
+	sp.id = id
+	for n := 2; taken(sp.id); n++ {
+		sp.id = fmt.Sprintf("%s-%d", id, n)
+	}
+	if sp.id != id {
+		si.warnf(sp.file, "ID %q is taken, using %q", id, sp.id)
+	}
+	si.posts = append(si.posts, sp)
+
+	if sp.oldUrl != "" {
+		si.addKey("url:"+normalizeUrlPath(sp.oldUrl), sp)
+	}
+}
+
+// Registers a way of referring to a post: "url:" plus an old URL path, or
+// an importer-specific kind of file reference. Keys that turn out to
+// refer to more than one post are useless, and map to nil.
+func (si *siteImport) addKey(key string, sp *sitePost) {
+	if other, ok := si.lookup[key]; ok && other != sp {
+		si.lookup[key] = nil
+		return
+	}
+	si.lookup[key] = sp
+}
+
+// Puts old URL paths in a form where the usual variations compare equal.
+func normalizeUrlPath(p string) string {
+	p = path.Clean("/" + p)
+	p = strings.TrimSuffix(p, "/index.html")
+	p = strings.TrimSuffix(p, ".html")
+	return strings.TrimSuffix(p, "/")
+}
+
+// Parses a front matter time. Both Jekyll and Hugo allow a time zone.
+func importTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		// Dates in old URLs are in the site's time zone, so keep offsets.
+		v = strings.TrimSpace(v)
+		for _, format := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05 -0700", "2006-01-02 15:04:05 -07:00", "2006-01-02 15:04 -0700"} {
+			if t, err := time.Parse(format, v); err == nil {
+				return t, true
+			}
+		}
+		if t, err := parseTime(v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Front matter lists can be proper lists or space-separated strings.
+func importList(value interface{}) []string {
+	var list []string
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s := strings.TrimSpace(fmt.Sprint(item)); s != "" {
+				list = append(list, s)
+			}
+		}
+	case string:
+		list = strings.Fields(v)
+	}
+	for i := range list {
+		// Commas separate list items in the header.
+		list[i] = strings.Replace(list[i], ",", " ", -1)
+	}
+	return list
+}
+
+// Takes a front matter property, so it doesn't get reported as unknown.
+func (sp *sitePost) take(keys ...string) interface{} {
+	for _, key := range keys {
+		if value, ok := sp.props[key]; ok {
+			delete(sp.props, key)
+			return value
+		}
+	}
+	return nil
+}
+
+func (sp *sitePost) takeString(keys ...string) string {
+	if value := sp.take(keys...); value != nil {
+		return strings.TrimSpace(fmt.Sprint(value))
+	}
+	return ""
+}
+
+// Works out the post's header from its front matter. The importers take
+// the properties they handle themselves (and set published) first.
+func (si *siteImport) setProperties(sp *sitePost, page bool) {
+	title := sp.takeString("title")
+	if title == "" {
+		title = sp.id
+	}
+	sp.set("title", title)
+	if page {
+		sp.set("type", "page")
+	}
+	if !sp.published.IsZero() {
+		sp.set("time", sp.published.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if value := sp.take("lastmod", "last_modified_at", "updated"); value != nil {
+		if t, ok := importTime(value); ok {
+			sp.set("updated", t.UTC().Format("2006-01-02 15:04:05"))
+		} else {
+			si.warnf(sp.file, "couldn't parse update time %v", value)
+		}
+	}
+
+	draft := false
+	if value := sp.take("draft"); value != nil {
+		draft = fmt.Sprint(value) == "true"
+	}
+	if value := sp.take("published"); value != nil {
+		draft = draft || fmt.Sprint(value) == "false"
+	}
+	if draft {
+		sp.set("draft", "true")
+	}
+
+	if slug := sp.takeString("slug"); slug != "" && slugify(slug) != "" {
+		sp.set("slug", slug)
+	}
+	sp.setList("tags", append(importList(sp.take("tags")), importList(sp.take("categories", "category"))...))
+	sp.set("summary", sp.takeString("summary", "excerpt"))
+
+	// The old URL keeps working; so do any old aliases.
+	var aliases []string
+	if sp.oldUrl != "" && !draft {
+		aliases = append(aliases, strings.TrimPrefix(sp.oldUrl, "/"))
+	}
+	for _, alias := range importList(sp.take("aliases")) {
+		aliases = append(aliases, strings.TrimPrefix(alias, "/"))
+	}
+	sp.setList("aliases", aliases)
+
+	for key := range sp.props {
+		if !si.ignore[key] {
+			si.unknown[key]++
+		}
+	}
+}
+
+// Applies f to the parts of markdown text that aren't fenced code blocks.
+func mapOutsideCode(text string, f func(string) string) string {
+	var out, chunk []string
+	fence := ""
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence == "" && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")):
+			fence = trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, trimmed[:1]))]
+			out = append(out, f(strings.Join(chunk, "")), line)
+			chunk = nil
+		case fence != "":
+			out = append(out, line)
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				fence = ""
+			}
+		default:
+			chunk = append(chunk, line)
+		}
+	}
+	out = append(out, f(strings.Join(chunk, "")))
+	return strings.Join(out, "")
+}
+
+// Markdown links and images, and reference definitions.
+var (
+	mdLink    = regexp.MustCompile(`(!?)(\[(?:[^\[\]]|\[[^\[\]]*\])*\]\(\s*)<?([^)\s>]*)>?((?:\s+(?:"[^"]*"|'[^']*'))?\s*\))`)
+	mdLinkDef = regexp.MustCompile(`(?m)^( {0,3}\[[^\]]+\]:[ \t]*)<?([^\s>]+)>?`)
+	htmlLink  = regexp.MustCompile(`(?i)<(?:a|img)\s[^>]*?(?:href|src)\s*=\s*["']([^"']*)["']`)
+)
+
+// Rewrites links to other posts into *id links and images into files in
+// the post's asset directory.
+func (si *siteImport) rewriteLinks(sp *sitePost, text string) string {
+	text = mdLink.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mdLink.FindStringSubmatch(m)
+		if sub[1] == "!" {
+			return sub[1] + sub[2] + si.image(sp, sub[3]) + sub[4]
+		}
+		return sub[2] + si.link(sp, sub[3]) + sub[4]
+	})
+	text = mdLinkDef.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mdLinkDef.FindStringSubmatch(m)
+		return sub[1] + si.link(sp, sub[2])
+	})
+
+	// HTML stays as it is, but local links in it won't work any more.
+	for _, sub := range htmlLink.FindAllStringSubmatch(text, -1) {
+		if _, local := si.localPath(sp, sub[1]); local {
+			si.warnf(sp.file, "can't convert link %q in HTML", sub[1])
+		}
+	}
+	return text
+}
+
+// If target is a site-local URL, returns its path from the site root,
+// without the base path.
+func (si *siteImport) localPath(sp *sitePost, target string) (string, bool) {
+	if target == "" || strings.HasPrefix(target, "#") || strings.HasPrefix(target, "*") {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	if u.Host != "" && (si.baseUrl == nil || u.Host != si.baseUrl.Host) {
+		return "", false
+	}
+
+	p := u.Path
+	if !strings.HasPrefix(p, "/") {
+		// Relative links are relative to the page's URL.
+		p = path.Join(path.Dir(sp.oldUrl+"x"), p)
+	} else if si.baseUrl != nil {
+		p = "/" + strings.TrimPrefix(strings.TrimPrefix(p, strings.TrimSuffix(si.baseUrl.Path, "/")), "/")
+	}
+	return p, true
+}
+
+// Returns the *id link for a link to another post, or the link as it is.
+func (si *siteImport) link(sp *sitePost, target string) string {
+	p, local := si.localPath(sp, target)
+	if !local {
+		return target
+	}
+	fragment := ""
+	if i := strings.IndexByte(target, '#'); i != -1 {
+		fragment = target[i:]
+	}
+
+	if other := si.lookup["url:"+normalizeUrlPath(p)]; other != nil {
+		return "*" + other.id + fragment
+	}
+	if other := si.lookup["file:"+path.Join(path.Dir(sp.file), strings.SplitN(target, "#", 2)[0])]; other != nil {
+		return "*" + other.id + fragment
+	}
+	si.warnf(sp.file, "link %q doesn't go to an imported post, left as it is", target)
+	return target
+}
+
+// Returns the name to use for an image: files in the post's bundle keep
+// their relative path, other local files get copied to its asset directory.
+func (si *siteImport) image(sp *sitePost, target string) string {
+	clean := strings.SplitN(strings.SplitN(target, "?", 2)[0], "#", 2)[0]
+	if u, err := url.Parse(clean); err == nil && u.IsAbs() && (si.baseUrl == nil || u.Host != si.baseUrl.Host) {
+		return target
+	}
+	if sp.bundle != "" && !path.IsAbs(clean) {
+		if name := path.Clean(clean); !strings.HasPrefix(name, "../") && sp.assets[name] != "" {
+			if strings.Contains(name, "/") {
+				// findImage takes paths with a slash relative to PostDir.
+				return sp.id + "/" + name
+			}
+			return name
+		}
+	}
+
+	p, local := si.localPath(sp, clean)
+	if !local {
+		return target
+	}
+	src := filepath.Join(si.staticDir, filepath.FromSlash(p))
+	if info, err := os.Stat(src); err == nil && !info.IsDir() {
+		name := sp.addAsset(path.Base(p), src)
+		return name
+	}
+	si.warnf(sp.file, "image %q not found, left as it is", target)
+	return target
+}
+
+// Adds all files in the post's bundle (except the post itself) as assets.
+func (si *siteImport) addBundle(sp *sitePost) error {
+	root := filepath.Join(si.contentDir, filepath.FromSlash(sp.bundle))
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); path.Join(sp.bundle, rel) != sp.file {
+			sp.addAsset(rel, file)
+		}
+		return nil
+	})
+}
+
+// Converts the posts' text, with the importer's conversions of template
+// tags: code blocks first, then everything else (which leaves code blocks
+// alone).
+func (si *siteImport) convert(codeTags, tags func(sp *sitePost, text string) string) {
+	for _, sp := range si.posts {
+		text := strings.Replace(sp.text, "\r\n", "\n", -1)
+		text = mapOutsideCode(text, func(text string) string { return codeTags(sp, text) })
+		sp.body = mapOutsideCode(text, func(text string) string {
+			return extraBlankLines.ReplaceAllString(si.rewriteLinks(sp, tags(sp, text)), "\n\n")
+		})
+	}
+}
+
+// Writes the posts, and reports what didn't get converted.
+func (si *siteImport) finish() error {
+	posts := make([]*importedPost, len(si.posts))
+	for i, sp := range si.posts {
+		posts[i] = &sp.importedPost
+	}
+	if err := writeImportedPosts(si.blog, posts); err != nil {
+		return err
+	}
+
+	for _, msg := range si.warnings {
+		Warnf("%s", msg)
+	}
+	keys := make([]string, 0, len(si.unknown))
+	for key := range si.unknown {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		Warnf("front matter key %q not converted (posts using it: %d)", key, si.unknown[key])
+	}
+	return nil
+}
+
+// Warns about template tags the importer doesn't know, once per post and
+// tag name. They stay in the text; unknown {% %} tags are shortcodes to us.
+func (si *siteImport) unknownTags(sp *sitePost, text string, tag *regexp.Regexp, kind string) {
+	seen := make(map[string]bool)
+	for _, sub := range tag.FindAllStringSubmatch(text, -1) {
+		if !seen[sub[1]] {
+			seen[sub[1]] = true
+			si.warnf(sp.file, "%s %q not converted", kind, sub[1])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJekyllUrl(t *testing.T) {
+	published := time.Date(2014, 3, 7, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		props     map[string]interface{}
+		permalink string
+		want      string
+	}{
+		{nil, jekyllPermalinkStyles["date"], "/2014/03/07/my-post.html"},
+		{nil, jekyllPermalinkStyles["pretty"], "/2014/03/07/my-post/"},
+		{nil, jekyllPermalinkStyles["ordinal"], "/2014/066/my-post.html"},
+		{map[string]interface{}{"categories": "Go Web"}, jekyllPermalinkStyles["date"], "/go/web/2014/03/07/my-post.html"},
+		{map[string]interface{}{"category": "News"}, jekyllPermalinkStyles["none"], "/news/my-post.html"},
+		{map[string]interface{}{"slug": "short"}, "/:short_year/:i_month/:i_day/:slug", "/14/3/7/short"},
+		{map[string]interface{}{"permalink": "/about/"}, jekyllPermalinkStyles["date"], "/about/"},
+	}
+	for _, test := range tests {
+		sp := &sitePost{props: test.props, published: published}
+		if got := jekyllUrl(sp, "my-post", test.permalink); got != test.want {
+			t.Errorf("%v, %q: got %q, want %q", test.props, test.permalink, got, test.want)
+		}
+	}
+}
+
+func TestHugoUrl(t *testing.T) {
+	published := time.Date(2014, 3, 7, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		props      map[string]interface{}
+		permalinks map[string]string
+		want       string
+	}{
+		{nil, nil, "/posts/my-post/"},
+		{map[string]interface{}{"slug": "Short"}, nil, "/posts/short/"},
+		{map[string]interface{}{"url": "/Exact/Path"}, nil, "/Exact/Path"},
+		{map[string]interface{}{"title": "Hello, World"}, map[string]string{"posts": "/:year/:monthname/:title/"}, "/2014/march/hello-world/"},
+		{nil, map[string]string{"posts": "/:year/:month/:day/:filename"}, "/2014/03/07/my-post"},
+		{nil, map[string]string{"posts": "/:weekday/:filename/"}, ""},
+	}
+	for _, test := range tests {
+		si := newSiteImport(NewBlog(), "content", "static", "")
+		sp := &sitePost{file: "posts/my-post.md", props: test.props, published: published}
+		if got := si.hugoUrl(sp, "my-post", "posts", test.permalinks); got != test.want {
+			t.Errorf("%v, %v: got %q, want %q", test.props, test.permalinks, got, test.want)
+		}
+	}
+}
+
+func TestConvertHighlightTags(t *testing.T) {
+	sp := &sitePost{}
+	tests := []struct {
+		convert    func(sp *sitePost, text string) string
+		text, want string
+	}{
+		{convertJekyllCode, "A\n{% highlight ruby linenos %}\nputs 1\n{% endhighlight %}\nB",
+			"A\n\n\n```ruby\nputs 1\n```\n\n\nB"},
+		{convertJekyllCode, "{%- highlight go -%}\nx := \"```\"\n{%- endhighlight -%}",
+			"\n\n````go\nx := \"```\"\n````\n\n"},
+		{convertHugoCode, "{{< highlight \"python\" \"linenos=table\" >}}\npass\n{{< /highlight >}}",
+			"\n\n```python\npass\n```\n\n"},
+		{convertHugoCode, "{{% highlight go %}}\nreturn\n{{% /highlight %}}",
+			"\n\n```go\nreturn\n```\n\n"},
+	}
+	for _, test := range tests {
+		if got := test.convert(sp, test.text); got != test.want {
+			t.Errorf("%q:\n got %q\nwant %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestMapOutsideCode(t *testing.T) {
+	mark := func(s string) string { return "<" + s + ">" }
+	tests := []struct {
+		text, want string
+	}{
+		{"a\nb", "<a\nb>"},
+		{"a\n```go\nx\n```\nb\n", "<a\n>```go\nx\n```\n<b\n>"},
+		{"~~~~\n```\nx\n~~~~\nb", "<>~~~~\n```\nx\n~~~~\n<b>"},
+	}
+	for _, test := range tests {
+		if got := mapOutsideCode(test.text, mark); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestImportList(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  []string
+	}{
+		{"go web", []string{"go", "web"}},
+		{[]interface{}{"Go", " web dev ", 2014, ""}, []string{"Go", "web dev", "2014"}},
+		{[]interface{}{"a,b"}, []string{"a b"}},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if got := importList(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%#v: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeUrlPath(t *testing.T) {
+	for _, p := range []string{"/a/b", "a/b/", "/a/b/index.html", "/a/b.html", "/a/./c/../b"} {
+		if got := normalizeUrlPath(p); got != "/a/b" {
+			t.Errorf("%q: got %q, want \"/a/b\"", p, got)
+		}
+	}
+}
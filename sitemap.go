@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	sitemapFile = "sitemap.xml"
+	robotsFile  = "robots.txt"
+)
+
+type sitemapUrlSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	Urls    []sitemapUrl `xml:"url"`
+}
+
+type sitemapUrl struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Value for the robots meta tag of the post's page, if it needs one.
+func (post *Post) Robots() string {
+	if post.NoIndex {
+		return "noindex"
+	}
+	return ""
+}
+
+// Crawlers only read robots.txt from the server root, so there's no point
+// in writing one for sites that live below it.
+func (blog *Blog) writesRobots() bool {
+	return blog.basePath() == ""
+}
+
+// Writes sitemap.xml, listing all pages except the ones marked noindex,
+// and robots.txt pointing to it (if the site is at the server root). Needs the home pages, so it goes after
+// writeOutputPosts.
+func (blog *Blog) writeSitemap() error {
+	set := sitemapUrlSet{}
+	add := func(url string, lastMod time.Time) {
+		u := sitemapUrl{Loc: url}
+		if !lastMod.IsZero() {
+			u.LastMod = lastMod.UTC().Format(time.RFC3339)
+		}
+		set.Urls = append(set.Urls, u)
+	}
+
+	// The home pages change whenever a post does.
+	var latest time.Time
+	for _, post := range blog.PostsByDate {
+		if post.Updated.After(latest) {
+			latest = post.Updated
+		}
+	}
+	add(blog.Url+"/", latest)
+	for _, page := range blog.homePages {
+		if page != indexPageName(1) {
+			add(blog.Url+"/"+page, latest)
+		}
+	}
+
+	lists := [][]*Post{blog.Pages, blog.TagPages, blog.PostsByDate, blog.Collections}
+	for _, list := range lists {
+		for _, post := range list {
+			if !post.NoIndex {
+				add(blog.postUrl(post), post.Updated)
+			}
+		}
+	}
+
+	data, err := xml.MarshalIndent(&set, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = blog.writeOutputFile(sitemapFile, append([]byte(xml.Header), data...)); err != nil {
+		return err
+	}
+
+	// Sites can provide their own robots.txt; either way, it gets a
+	// pointer to the sitemap.
+	robots, err := ioutil.ReadFile(filepath.Join(blog.TemplateDir, robotsFile))
+	custom := err == nil
+	if os.IsNotExist(err) {
+		robots, err = []byte("User-agent: *\nDisallow:\n"), nil
+	}
+	if err != nil {
+		return err
+	}
+	if !blog.writesRobots() {
+		if custom {
+			Warnf("%s not written: crawlers only look for it at the server root, and the site is at %q.", robotsFile, blog.Url)
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(bytes.TrimRight(robots, "\n"))
+	fmt.Fprintf(&buf, "\n\nSitemap: %s/%s\n", blog.Url, sitemapFile)
+	return blog.writeOutputFile(robotsFile, buf.Bytes())
+}
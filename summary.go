@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Posts get a summary for teasers on the home page and in feeds. It's the
+// "summary" property if there is one, else everything before a
+// <!--more--> marker, else the first SummaryWords words.
+
+const moreMarker = "<!--more-->"
+
+// Tags and comments in rendered HTML.
+var htmlTag = regexp.MustCompile(`<!--[\s\S]*?-->|<[^>]*>`)
+
+// Elements without end tags.
+var voidElements = wordSet(`area base br col embed hr img input link meta
+	param source track wbr`)
+
+// Elements we never cut into, and whose text doesn't count as words.
+var atomicElements = wordSet(`pre code script style math noscript`)
+
+// Elements whose text doesn't belong in a plain-text summary.
+var hiddenElements = wordSet(`script style annotation`)
+
+// Returns the element name of a tag, and whether it opens or closes it.
+// Comments, doctypes, void elements and self-closing tags do neither.
+func parseTag(tag string) (name string, open, close bool) {
+	if strings.HasPrefix(tag, "<!") || strings.HasPrefix(tag, "<?") {
+		return "", false, false
+	}
+	close = strings.HasPrefix(tag, "</")
+	name = strings.TrimLeft(tag, "</")
+	if end := strings.IndexAny(name, " \t\r\n/>"); end != -1 {
+		name = name[:end]
+	}
+	name = strings.ToLower(name)
+	if close || voidElements[name] || strings.HasSuffix(tag, "/>") {
+		return name, false, close
+	}
+	return name, true, false
+}
+
+// Tracks which elements are open while scanning HTML.
+type elementStack []string
+
+func (s *elementStack) update(tag string) {
+	name, open, close := parseTag(tag)
+	switch {
+	case open:
+		*s = append(*s, name)
+	case close:
+		for i := len(*s) - 1; i >= 0; i-- {
+			if (*s)[i] == name {
+				*s = (*s)[:i]
+				break
+			}
+		}
+	}
+}
+
+func (s elementStack) inside(set map[string]bool) bool {
+	for _, name := range s {
+		if set[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Closing tags for all open elements.
+func (s elementStack) closeTags() string {
+	var buf bytes.Buffer
+	for i := len(s) - 1; i >= 0; i-- {
+		buf.WriteString("</" + s[i] + ">")
+	}
+	return buf.String()
+}
+
+// Returns the summary of the rendered content, and whether there's more
+// to the post than that.
+func summarize(content []byte, words int) (summary []byte, more bool) {
+	if i := bytes.Index(content, []byte(moreMarker)); i != -1 {
+		var stack elementStack
+		for _, tag := range htmlTag.FindAll(content[:i], -1) {
+			stack.update(string(tag))
+		}
+		summary = append(bytes.TrimSpace(content[:i:i]), stack.closeTags()...)
+		return summary, true
+	}
+	return truncateHtml(content, words)
+}
+
+// Cuts HTML down to about the given number of words. Whole paragraphs are
+// kept if possible; if not, the text gets cut at a word boundary and the
+// open elements are closed.
+func truncateHtml(content []byte, words int) ([]byte, bool) {
+	var buf bytes.Buffer
+	var stack elementStack
+	count := 0
+
+	// The rest of the post, starting at pos, is more than just whitespace?
+	moreAt := func(pos int) bool {
+		return len(bytes.TrimSpace(content[pos:])) > 0
+	}
+
+	pos := 0
+	for _, loc := range htmlTag.FindAllIndex(content, -1) {
+		// Text before the tag
+		if text := content[pos:loc[0]]; len(text) > 0 && !stack.inside(atomicElements) {
+			if cut := wordOffset(text, words-count); cut != -1 {
+				buf.Write(bytes.TrimSpace(text[:cut]))
+				buf.WriteString("…")
+				buf.WriteString(stack.closeTags())
+				return buf.Bytes(), true
+			}
+			count += len(bytes.Fields(text))
+		}
+		buf.Write(content[pos:loc[0]])
+		pos = loc[0]
+
+		// Stop between top-level elements once we have enough.
+		if len(stack) == 0 && count >= words {
+			return bytes.TrimSpace(buf.Bytes()), moreAt(pos)
+		}
+
+		buf.Write(content[loc[0]:loc[1]])
+		stack.update(string(content[loc[0]:loc[1]]))
+		pos = loc[1]
+	}
+
+	text := content[pos:]
+	if cut := wordOffset(text, words-count); cut != -1 {
+		buf.Write(bytes.TrimSpace(text[:cut]))
+		buf.WriteString("…")
+		return buf.Bytes(), true
+	}
+	buf.Write(text)
+	return bytes.TrimSpace(buf.Bytes()), false
+}
+
+// Offset of the word after the first n words in text, or -1 if there
+// aren't more than n.
+func wordOffset(text []byte, n int) int {
+	inWord := false
+	for i, ch := range text {
+		if isSpace(ch) {
+			inWord = false
+		} else if !inWord {
+			if n == 0 {
+				return i
+			}
+			n--
+			inWord = true
+		}
+	}
+	return -1
+}
+
+// Turns rendered HTML into plain text.
+func htmlToText(content []byte) string {
+	var buf bytes.Buffer
+	var stack elementStack
+
+	pos := 0
+	for _, loc := range htmlTag.FindAllIndex(content, -1) {
+		if !stack.inside(hiddenElements) {
+			buf.Write(content[pos:loc[0]])
+		}
+		tag := string(content[loc[0]:loc[1]])
+		if name, _, _ := parseTag(tag); name == "br" || name == "p" {
+			buf.WriteByte(' ')
+		}
+		stack.update(tag)
+		pos = loc[1]
+	}
+	buf.Write(content[pos:])
+
+	return strings.Join(strings.Fields(html.UnescapeString(buf.String())), " ")
+}
+
+// Renders a post's summary, given its rendered content.
+func (post *Post) renderSummary(blog *Blog, content []byte, feed bool) (summary []byte, more bool, err error) {
+	if post.summary == "" {
+		summary, more = summarize(content, blog.SummaryWords)
+		return summary, more, nil
+	}
+
+	renderer := newHtmlRenderer(post, blog)
+	renderer.feed = feed
+	summary, err = renderer.render([]byte(post.summary))
+	return summary, true, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		content string
+		words   int
+		want    string
+		more    bool
+	}{
+		// The <!--more--> marker wins over the word count.
+		{"<p>One two.</p>\n<!--more-->\n<p>Three.</p>", 1,
+			"<p>One two.</p>", true},
+		{"<p>One <em>two<!--more--> three</em> four.</p>", 10,
+			"<p>One <em>two</em></p>", true},
+
+		// Whole paragraphs if possible.
+		{"<p>One two.</p>\n", 5,
+			"<p>One two.</p>", false},
+		{"<p>One two.</p>\n<p>Three four.</p>\n<p>Five.</p>", 2,
+			"<p>One two.</p>", true},
+		{"<p>One two.</p>\n<p>Three four.</p>\n", 4,
+			"<p>One two.</p>\n<p>Three four.</p>", false},
+
+		// Else cut at a word and close the open elements.
+		{"<p>One <em>two three</em> four.</p>", 2,
+			"<p>One <em>two…</em></p>", true},
+		{"<ul><li>One</li><li>two three</li></ul>", 2,
+			"<ul><li>One</li><li>two…</li></ul>", true},
+		{"one two three", 2,
+			"one two…", true},
+
+		// Code doesn't count as words, and doesn't get cut.
+		{"<pre><code>a b c d</code></pre>\n<p>e</p>", 2,
+			"<pre><code>a b c d</code></pre>\n<p>e</p>", false},
+		{"<p>Run <code>a b c</code> now.</p>\n<p>Next.</p>", 2,
+			"<p>Run <code>a b c</code> now.</p>", true},
+
+		// Void elements need no end tags.
+		{"<p>A<br>b <img src=\"x.png\"> c</p>", 2,
+			"<p>A<br>b <img src=\"x.png\">…</p>", true},
+	}
+	for _, test := range tests {
+		summary, more := summarize([]byte(test.content), test.words)
+		if string(summary) != test.want || more != test.more {
+			t.Errorf("%q, %d words:\n got %q, %v\nwant %q, %v",
+				test.content, test.words, summary, more, test.want, test.more)
+		}
+	}
+}
+
+func TestHtmlToText(t *testing.T) {
+	tests := []struct {
+		content, want string
+	}{
+		{"<p>a &amp; b</p><p>c<br>d</p>", "a & b c d"},
+		{"  <h2 id=\"x\">Title</h2>\n\n<p>Some\n  text.</p>", "Title Some text."},
+		{"a<!-- c -->b", "ab"},
+		{"<script>x()</script><style>p {}</style>y", "y"},
+		{"<math><semantics><mi>x</mi><annotation encoding=\"application/x-tex\">x</annotation></semantics></math>", "x"},
+	}
+	for _, test := range tests {
+		if got := htmlToText([]byte(test.content)); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.content, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type Tag struct {
+	Name     string
+	Slug     string  // used in file names
+	Posts    []*Post // posts with this tag, most recent first
+	Page     *Post   // generated index page
+	FeedFile string  // name of the Atom feed for this tag
+
+	atomFeed []byte
+}
+
+type tagsByName []*Tag
+
+func (t tagsByName) Len() int { return len(t) }
+func (t tagsByName) Less(i, j int) bool {
+	a, b := strings.ToLower(t[i].Name), strings.ToLower(t[j].Name)
+	return a < b || a == b && t[i].Name < t[j].Name
+}
+func (t tagsByName) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+// Turns a tag name into something usable in file names and URLs. Letters
+// and digits (in any script) are kept; runs of other characters turn into
+// single dashes, except for a few that are common in programming language
+// names ("C++", "C#").
+func slugify(name string) string {
+	var buf bytes.Buffer
+	dash := false
+	for _, ch := range strings.ToLower(name) {
+		var str string
+		switch {
+		case unicode.IsLetter(ch) || unicode.IsDigit(ch):
+			str = string(ch)
+		case unicode.Is(unicode.Mn, ch) && !dash && buf.Len() > 0:
+			// Accents written as combining marks stay with their letter.
+			str = string(ch)
+		case ch == '+':
+			str = "p"
+		case ch == '#':
+			str = "sharp"
+		default:
+			dash = true
+			continue
+		}
+
+		if dash && buf.Len() > 0 {
+			buf.WriteByte('-')
+		}
+		buf.WriteString(str)
+		dash = false
+	}
+	return buf.String()
+}
+
+// Builds the tag index from the tags of all posts. Needs PostsByDate.
+// Tags that only differ in case or punctuation ("Go", "go") are the same
+// tag; its name is taken from the most recent post using it.
+func (blog *Blog) indexTags() error {
+	bySlug := make(map[string]*Tag)
+
+	for _, post := range blog.PostsByDate {
+		for _, name := range post.Tags {
+			slug := slugify(name)
+			if slug == "" {
+				return fmt.Errorf("%q: tag %q needs to contain at least one letter or digit.", post.Id, name)
+			}
+
+			tag := bySlug[slug]
+			if tag == nil {
+				tag = &Tag{
+					Name:     name,
+					Slug:     slug,
+					FeedFile: "tag_" + slug + ".atom.xml",
+				}
+				bySlug[slug] = tag
+				blog.Tags = append(blog.Tags, tag)
+			}
+
+			// A post can list the same tag twice in different spellings.
+			if n := len(tag.Posts); n > 0 && tag.Posts[n-1] == post {
+				continue
+			}
+
+			// PostsByDate is sorted, so this is too.
+			tag.Posts = append(tag.Posts, post)
+		}
+	}
+
+	sort.Sort(tagsByName(blog.Tags))
+	return nil
+}
+
+// Escapes text so markdown renders it literally.
+func markdownEscape(text string) string {
+	var buf bytes.Buffer
+	for _, ch := range text {
+		if strings.ContainsRune("\\`*_{}[]()<>#+-.!", ch) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(ch)
+	}
+	return buf.String()
+}
+
+// Adds a generated post to the blog, making sure its ID doesn't clash
+// with a real one.
+func (blog *Blog) addGeneratedPost(post *Post) error {
+	if other := blog.FindPostById(post.Id); other != nil {
+		return fmt.Errorf("%q: post ID is reserved for a generated page.", post.Id)
+	}
+	blog.AllPosts = append(blog.AllPosts, post)
+	return nil
+}
+
+// Generates an index page for every tag, plus the "Tags" standalone page
+// listing all of them.
+func (blog *Blog) GenerateTagPages() error {
+	if len(blog.Tags) == 0 {
+		return nil
+	}
+
+	overview := new(bytes.Buffer)
+	overview.WriteString("-type=page\n")
+	overview.WriteString("-title=Tags\n\n")
+
+	for _, tag := range blog.Tags {
+		buf := new(bytes.Buffer)
+		buf.WriteString("-type=page\n")
+		fmt.Fprintf(buf, "-title=Posts tagged “%s”\n\n", tag.Name)
+		for _, post := range tag.Posts {
+			fmt.Fprintf(buf, "* [%%](*%s) (%s)\n", post.Id, post.Published.Format("January 2, 2006"))
+		}
+
+		page, err := NewPost("tag_"+tag.Slug, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		page.Params = map[string]interface{}{
+			"tag":      tag.Name,
+			"tag_feed": blog.linkTo(tag.FeedFile),
+		}
+		if err = blog.addGeneratedPost(page); err != nil {
+			return err
+		}
+		tag.Page = page
+		blog.TagPages = append(blog.TagPages, page)
+
+		fmt.Fprintf(overview, "* [%s](*%s) (%d)\n", markdownEscape(tag.Name), page.Id, len(tag.Posts))
+	}
+
+	post, err := NewPost("tags", overview.Bytes())
+	if err != nil {
+		return err
+	}
+	if err = blog.addGeneratedPost(post); err != nil {
+		return err
+	}
+	blog.Pages = append(blog.Pages, post)
+	return nil
+}
+
+// Renders the per-tag Atom feeds.
+func (blog *Blog) renderTagFeeds() error {
+	for _, tag := range blog.Tags {
+		title := fmt.Sprintf("%s: %s", blog.Title, tag.Name)
+		alternate := blog.Url
+		if tag.Page != nil {
+			alternate = blog.postUrl(tag.Page)
+		}
+
+		feed := &feedInfo{
+			Title:     title,
+			Id:        blog.atomIdBase() + "tag/" + tag.Slug,
+			Alternate: alternate,
+			posts:     tag.Posts,
+		}
+		data, err := blog.atomFeedFor(feed, tag.FeedFile, blog.NumFeedPosts)
+		if err != nil {
+			return err
+		}
+		tag.atomFeed = data
+	}
+	return nil
+}
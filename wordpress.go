@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Imports a WordPress export (WXR) file. Posts and pages become post files;
+// nothing gets downloaded, but images from the WP uploads directory are
+// mapped into the posts' asset directories, and the files to fetch are
+// listed in wordpressManifest.
+const wordpressManifest = "wordpress-attachments.txt"
+
+type wxrExport struct {
+	Channel struct {
+		BaseSiteUrl string    `xml:"base_site_url"`
+		BaseBlogUrl string    `xml:"base_blog_url"`
+		Items       []wxrItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type wxrItem struct {
+	Title         string        `xml:"title"`
+	Link          string        `xml:"link"`
+	Encoded       []wxrEncoded  `xml:"encoded"` // content:encoded and excerpt:encoded
+	PostId        string        `xml:"post_id"`
+	PostDate      string        `xml:"post_date"`
+	PostModified  string        `xml:"post_modified"`
+	PostName      string        `xml:"post_name"`
+	Status        string        `xml:"status"`
+	PostType      string        `xml:"post_type"`
+	PostParent    string        `xml:"post_parent"`
+	AttachmentUrl string        `xml:"attachment_url"`
+	Categories    []wxrCategory `xml:"category"`
+}
+
+type wxrEncoded struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type wxrCategory struct {
+	Domain string `xml:"domain,attr"` // "category" or "post_tag"
+	Name   string `xml:",chardata"`
+}
+
+// Text of the content:encoded or excerpt:encoded element.
+func (item *wxrItem) encoded(ns string) string {
+	for _, e := range item.Encoded {
+		// The excerpt namespace has the export version in it.
+		if strings.Contains(e.XMLName.Space, ns) {
+			return e.Text
+		}
+	}
+	return ""
+}
+
+// A WordPress import in progress.
+type wpImport struct {
+	blog        *Blog
+	base        string                // old blog URL without scheme, e.g. "example.com/blog"
+	basePath    string                // path of the old blog on its server
+	uploads     string                // uploads URL without scheme
+	attachments map[string][]*wxrItem // by parent post_id
+	byId        map[string]*wxrItem
+	manifest    map[string]string // asset path -> URL to fetch it from
+	warnings    []string
+	kept        []wpKept // converted parts of the current post, see keep
+}
+
+// Markdown made from part of a WP post, and the HTML it came from.
+type wpKept struct {
+	md, orig string
+}
+
+func runImportWordpress(blog *Blog, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import wordpress <export.xml>")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var export wxrExport
+	if err := xml.Unmarshal(data, &export); err != nil {
+		return fmt.Errorf("%s: %s", args[0], err.Error())
+	}
+
+	ch := &export.Channel
+	siteUrl := ch.BaseSiteUrl
+	if ch.BaseBlogUrl != "" {
+		siteUrl = ch.BaseBlogUrl
+	}
+	wp := &wpImport{
+		blog:        blog,
+		base:        stripScheme(siteUrl),
+		uploads:     stripScheme(ch.BaseSiteUrl) + "/wp-content/uploads/",
+		attachments: make(map[string][]*wxrItem),
+		byId:        make(map[string]*wxrItem),
+		manifest:    make(map[string]string),
+	}
+	if u, err := url.Parse(siteUrl); err == nil {
+		wp.basePath = strings.TrimSuffix(u.Path, "/")
+	}
+
+	for i := range ch.Items {
+		item := &ch.Items[i]
+		wp.byId[item.PostId] = item
+		if item.PostType == "attachment" {
+			wp.attachments[item.PostParent] = append(wp.attachments[item.PostParent], item)
+		}
+	}
+
+	var posts []*importedPost
+	usedIds := make(map[string]bool)
+	for i := range ch.Items {
+		item := &ch.Items[i]
+		if item.PostType != "post" && item.PostType != "page" {
+			continue
+		}
+		if item.Status == "trash" || item.Status == "auto-draft" || item.Status == "inherit" {
+			continue
+		}
+
+		post := wp.convert(item, usedIds)
+		if post == nil {
+			continue
+		}
+		usedIds[post.id] = true
+		posts = append(posts, post)
+	}
+
+	if err := writeImportedPosts(blog, posts); err != nil {
+		return err
+	}
+	for _, msg := range wp.warnings {
+		Warnf("%s", msg)
+	}
+	if len(wp.manifest) == 0 {
+		return nil
+	}
+
+	// One "<url> <path>" line per file, for wget, curl or a script.
+	paths := make([]string, 0, len(wp.manifest))
+	for p := range wp.manifest {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var buf bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintf(&buf, "%s %s\n", wp.manifest[p], p)
+	}
+	if err := ioutil.WriteFile(wordpressManifest, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%d images need to be fetched from the old site; they're listed in %q.\n", len(paths), wordpressManifest)
+	return nil
+}
+
+func stripScheme(u string) string {
+	if i := strings.Index(u, "//"); i != -1 {
+		u = u[i+2:]
+	}
+	return strings.TrimSuffix(u, "/")
+}
+
+func (wp *wpImport) warnf(item *wxrItem, msg string, args ...interface{}) {
+	wp.warnings = append(wp.warnings, fmt.Sprintf("WordPress post %s (%q): ", item.PostId, item.Title)+fmt.Sprintf(msg, args...))
+}
+
+// Picks a post ID: the WP slug if usable, else one made from the title.
+func (wp *wpImport) postId(item *wxrItem, used map[string]bool) string {
+	id, err := url.PathUnescape(item.PostName)
+	if err != nil || !validPostId(id) {
+		id = slugify(item.Title)
+	}
+	if id == "" {
+		id = "wp-" + item.PostId
+	}
+	if used[id] {
+		id += "-" + item.PostId
+	}
+	return id
+}
+
+// Converts a post or page, or returns nil (with a warning) if it can't.
+func (wp *wpImport) convert(item *wxrItem, used map[string]bool) *importedPost {
+	post := &importedPost{id: wp.postId(item, used)}
+
+	title := strings.TrimSpace(html.UnescapeString(item.Title))
+	if title == "" {
+		title = post.id
+	}
+	post.set("title", title)
+	if item.PostType == "page" {
+		post.set("type", "page")
+	}
+
+	published, err := time.Parse("2006-01-02 15:04:05", item.PostDate)
+	if err != nil {
+		wp.warnf(item, "bad post_date %q, skipped", item.PostDate)
+		return nil
+	}
+	post.set("time", published.Format("2006-01-02 15:04:05"))
+	if modified, err := time.Parse("2006-01-02 15:04:05", item.PostModified); err == nil && modified.After(published) {
+		post.set("updated", modified.Format("2006-01-02 15:04:05"))
+	}
+	switch item.Status {
+	case "draft", "pending", "private":
+		post.set("draft", "true")
+	}
+
+	// Keep the WP slug if the title wouldn't give the same one, so
+	// permalinks using :slug come out the same as on the old site.
+	if slugify(title) != post.id {
+		post.set("slug", post.id)
+	}
+
+	var tags []string
+	for _, cat := range item.Categories {
+		name := strings.TrimSpace(html.UnescapeString(cat.Name))
+		if (cat.Domain == "category" || cat.Domain == "post_tag") && name != "" && name != "Uncategorized" {
+			// Commas separate list items in the header.
+			tags = append(tags, strings.Replace(name, ",", " ", -1))
+		}
+	}
+	post.setList("tags", tags)
+
+	if excerpt := strings.TrimSpace(item.encoded("excerpt")); excerpt != "" {
+		post.set("summary", htmlToText([]byte(excerpt)))
+	}
+
+	// Published posts keep their old URLs working. (Plain "?p=123" links
+	// can't be redirected with static files, so those are skipped.)
+	if alias := wp.oldPath(item.Link); alias != "" && item.Status == "publish" {
+		post.set("aliases", alias)
+	}
+
+	post.body = wp.convertContent(item, post.id, item.encoded("content"))
+	return post
+}
+
+// Path of an old WP URL relative to the blog root, if it's a usable alias.
+func (wp *wpImport) oldPath(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.RawQuery != "" || !strings.HasPrefix(stripScheme(link), wp.base) {
+		return ""
+	}
+	p := strings.TrimPrefix(strings.TrimPrefix(u.Path, wp.basePath), "/")
+	if p == "" || strings.Contains(p, ",") {
+		return ""
+	}
+	return p
+}
+
+// Converts the content of a WP post to markdown. WP content is HTML in
+// which blank lines separate paragraphs and single newlines are line breaks
+// (wpautop adds the tags when showing it). Shortcodes and images turn into
+// markdown; the rest stays HTML, with its text escaped so markdown takes it
+// literally.
+func (wp *wpImport) convertContent(item *wxrItem, id, content string) string {
+	wp.kept = nil
+	content = strings.Replace(content, "\r\n", "\n", -1)
+	content = wp.convertShortcodes(item, id, content)
+	content = wpLatex.ReplaceAllStringFunc(content, func(m string) string {
+		return wp.keep("$"+wpLatexTex(wpLatex.FindStringSubmatch(m)[1])+"$", m)
+	})
+	content = wpPreformatted.ReplaceAllStringFunc(content, func(m string) string {
+		return "\n\n" + wp.keep(m, m) + "\n\n"
+	})
+	content = wp.convertImages(item, id, content)
+
+	var out []string
+	paras := wpParagraphBreak.Split(strings.TrimSpace(content), -1)
+	for i := 0; i < len(paras); i++ {
+		para := paras[i]
+		tag := wpLeadingTag(para)
+		switch {
+		case wpPlaceholder.FindString(para) == para:
+			out = append(out, wp.restore(para, false))
+
+		case tag != "" && (wpBlockTags[tag] || tag == "!--"):
+			// Markdown leaves HTML blocks alone up to their end tag, so
+			// paragraphs inside need the tags wpautop would give them.
+			block := []string{para}
+			for wpOpenTags(strings.Join(block, "\n"), tag) > 0 && i+1 < len(paras) {
+				i++
+				block = append(block, paras[i])
+			}
+			if len(block) > 1 {
+				first, last := block[0], block[len(block)-1]
+				if end := strings.IndexByte(first, '>') + 1; end > 0 {
+					block[0] = first[:end] + "<p>" + first[end:]
+				}
+				if end := strings.LastIndex(last, "</"); end != -1 {
+					block[len(block)-1] = last[:end] + "</p>" + last[end:]
+				}
+			}
+			html := strings.Join(block, "</p>\n<p>")
+			if wpPlaceholder.MatchString(html) {
+				wp.warnf(item, "markdown doesn't work inside HTML blocks, so images and code in them are left as they were")
+			}
+			out = append(out, wp.restore(html, true))
+
+		default:
+			out = append(out, wp.restore(wpEscapeText(para), false))
+		}
+	}
+	return extraBlankLines.ReplaceAllString(strings.Join(out, "\n\n"), "\n\n")
+}
+
+// Sets converted markdown aside, so later steps leave it alone, and
+// returns a placeholder for it. Newlines around md stay around the
+// placeholder.
+func (wp *wpImport) keep(md, orig string) string {
+	trimmed := strings.Trim(md, "\n")
+	if trimmed == "" {
+		return md
+	}
+	start := strings.Index(md, trimmed)
+	wp.kept = append(wp.kept, wpKept{trimmed, orig})
+	return fmt.Sprintf("%s\x00%d\x00%s", md[:start], len(wp.kept)-1, md[start+len(trimmed):])
+}
+
+// Puts kept parts back in, as markdown or as their original HTML.
+func (wp *wpImport) restore(text string, orig bool) string {
+	return wpPlaceholder.ReplaceAllStringFunc(text, func(m string) string {
+		n, _ := strconv.Atoi(strings.Trim(m, "\x00"))
+		if orig {
+			return wp.kept[n].orig
+		}
+		return wp.restore(wp.kept[n].md, false)
+	})
+}
+
+var (
+	wpPlaceholder    = regexp.MustCompile(`\x00\d+\x00`)
+	wpParagraphBreak = regexp.MustCompile(`\n[ \t]*\n\s*`)
+	wpPreformatted   = regexp.MustCompile(`(?is)<(pre|script|style)[\s>].*?</(?:pre|script|style)>`)
+	wpHtmlTag        = regexp.MustCompile(`<[^>]*>`)
+	wpLineStart      = regexp.MustCompile(`(?m)^[ \t]*(?:[#>+=-]|\d+\.)`)
+	wpLineBreak      = regexp.MustCompile(`(?i)(<br\s*/?>)?\n`)
+
+	// What markdown takes for formatting anywhere in text.
+	wpEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "{", `\{`, "}", `\}`, "$", `\$`)
+)
+
+// The tags wpautop doesn't put in paragraphs.
+var wpBlockTags = wordSet("address article aside blockquote caption col colgroup dd details div dl dt fieldset figcaption figure footer form h1 h2 h3 h4 h5 h6 header hgroup hr iframe legend li map math menu nav object ol p pre script section style summary table tbody td tfoot th thead tr ul")
+
+// Name of the tag text starts with, lowercased; "!--" for a comment.
+func wpLeadingTag(text string) string {
+	if strings.HasPrefix(text, "<!--") {
+		return "!--"
+	}
+	if !strings.HasPrefix(text, "<") {
+		return ""
+	}
+	n := 1
+	for n < len(text) && (isWord(text[n]) || text[n] == '-') {
+		n++
+	}
+	return strings.ToLower(text[1:n])
+}
+
+// How many tags named tag (or comments, for "!--") are still open at the
+// end of text.
+func wpOpenTags(text, tag string) int {
+	if tag == "!--" {
+		return strings.Count(text, "<!--") - strings.Count(text, "-->")
+	}
+	open := 0
+	for _, m := range wpHtmlTag.FindAllString(text, -1) {
+		switch {
+		case wpLeadingTag(m) == tag && !strings.HasSuffix(m, "/>"):
+			open++
+		case strings.HasPrefix(m, "</") && wpLeadingTag("<"+m[2:]) == tag:
+			open--
+		}
+	}
+	if tag == "hr" || open < 0 {
+		return 0
+	}
+	return open
+}
+
+// Escapes the text of a WP paragraph (but not its tags) for markdown, and
+// turns its line breaks into <br> tags.
+func wpEscapeText(para string) string {
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range wpHtmlTag.FindAllStringIndex(para, -1) {
+		buf.WriteString(wpEscaper.Replace(para[last:loc[0]]))
+		buf.WriteString(para[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	buf.WriteString(wpEscaper.Replace(para[last:]))
+
+	// Lines that would start a heading, quote or list.
+	text := wpLineStart.ReplaceAllStringFunc(buf.String(), func(m string) string {
+		return m[:len(m)-1] + `\` + m[len(m)-1:]
+	})
+	return wpLineBreak.ReplaceAllStringFunc(strings.TrimSpace(text), func(m string) string {
+		if m == "\n" {
+			return "<br>\n"
+		}
+		return m
+	})
+}
+
+// Languages that SyntaxHighlighter accepts as shortcodes of their own, as in
+// [python]...[/python].
+var wpCodeLanguages = wordSet("as3 actionscript3 bash shell c cpp csharp css delphi pascal diff patch erlang go groovy haskell html java javafx js javascript jscript matlab objc perl pl php powershell ps py python r ruby rails scala sql swift vb xml xhtml xslt")
+
+// Finds the next shortcode in text at or after pos. Returns the position
+// of the opening "[", the shortcode name and attributes, and the end of
+// the opening tag.
+func nextWpShortcode(text string, pos int) (start int, name, attrs string, end int) {
+	for {
+		i := strings.IndexByte(text[pos:], '[')
+		if i == -1 {
+			return -1, "", "", 0
+		}
+		start = pos + i
+		pos = start + 1
+
+		n := start + 1
+		for n < len(text) && (isWord(text[n]) || text[n] == '-') {
+			n++
+		}
+		if n == start+1 || n >= len(text) || (text[n] != ']' && text[n] != '/' && !isSpace(text[n])) {
+			continue
+		}
+		close := strings.IndexByte(text[n:], ']')
+		if close == -1 {
+			return -1, "", "", 0
+		}
+		return start, text[start+1 : n], strings.TrimSuffix(text[n:n+close], "/"), n + close + 1
+	}
+}
+
+func (wp *wpImport) convertShortcodes(item *wxrItem, id, content string) string {
+	var out bytes.Buffer
+	unsupported := make(map[string]bool)
+	pos := 0
+	for {
+		start, name, attrs, end := nextWpShortcode(content, pos)
+		if start == -1 {
+			break
+		}
+
+		// [[name]] is an escaped shortcode, shown as [name].
+		if start > 0 && content[start-1] == '[' && end < len(content) && content[end] == ']' {
+			out.WriteString(content[pos : start-1])
+			out.WriteString(content[start:end])
+			pos = end + 1
+			continue
+		}
+
+		// Enclosing shortcodes end in [/name]; without one, it's a
+		// self-closing one.
+		inner, after := "", end
+		closeTag := "[/" + name + "]"
+		if i := strings.Index(content[end:], closeTag); i != -1 {
+			inner, after = content[end:end+i], end+i+len(closeTag)
+		}
+		args := parseAttrs(attrs)
+
+		var repl string
+		lower := strings.ToLower(name)
+		switch {
+		case lower == "sourcecode" || lower == "source" || lower == "code" || wpCodeLanguages[lower] && after != end:
+			lang := args["lang"]
+			if lang == "" {
+				lang = args["language"]
+			}
+			if lang == "" && lower != "sourcecode" && lower != "source" && lower != "code" {
+				lang = lower
+			}
+			repl = fencedCode(lang, html.UnescapeString(inner))
+		case lower == "latex":
+			repl = "$$" + wpLatexTex(inner) + "$$"
+		case lower == "caption":
+			repl = wp.convertCaption(item, id, inner)
+		case lower == "gallery":
+			repl = wp.convertGallery(item, id, args)
+		default:
+			if !unsupported[name] {
+				unsupported[name] = true
+				wp.warnf(item, "unsupported shortcode [%s] left as it is", name)
+			}
+			out.WriteString(content[pos:end])
+			pos = end
+			continue
+		}
+
+		out.WriteString(content[pos:start])
+		out.WriteString(wp.keep(repl, content[start:after]))
+		pos = after
+	}
+	out.WriteString(content[pos:])
+	return out.String()
+}
+
+// A fenced code block, on lines of its own. The fence is longer than any
+// run of backticks in the code.
+func fencedCode(lang, code string) string {
+	code = strings.Trim(code, "\n")
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fmt.Sprintf("\n\n%s%s\n%s\n%s\n\n", fence, lang, code, fence)
+}
+
+// WordPress.com style inline math: $latex e^{i\pi}+1=0$.
+var wpLatex = regexp.MustCompile(`\$latex\s+((?:[^$\\]|\\.)*)\$`)
+
+// WP latex options like "&bg=ffffff&fg=000000&s=1" only set colors and
+// sizes, so they go.
+var wpLatexOptions = regexp.MustCompile(`(?:&(?:amp;)?(?:bg|fg|s)=[0-9a-zA-Z]*)+\s*$`)
+
+func wpLatexTex(tex string) string {
+	tex = wpLatexOptions.ReplaceAllString(tex, "")
+	return strings.TrimSpace(html.UnescapeString(tex))
+}
+
+// [caption]<img ...> Text[/caption] becomes a figure shortcode.
+func (wp *wpImport) convertCaption(item *wxrItem, id, inner string) string {
+	inner = strings.TrimSpace(inner)
+	imgEnd := 0
+	if loc := wpImage.FindStringIndex(inner); loc != nil && loc[0] == 0 {
+		imgEnd = loc[1]
+	}
+	img := wp.convertImages(item, id, inner[:imgEnd])
+	return figureShortcode(img, wpEscapeText(inner[imgEnd:]))
+}
+
+// [gallery] shows the images attached to the post, or those listed in ids.
+func (wp *wpImport) convertGallery(item *wxrItem, id string, args map[string]string) string {
+	var images []*wxrItem
+	if ids := args["ids"]; ids != "" {
+		for _, aid := range strings.Split(ids, ",") {
+			if a := wp.byId[strings.TrimSpace(aid)]; a != nil {
+				images = append(images, a)
+			}
+		}
+	} else {
+		images = wp.attachments[item.PostId]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\n\n")
+	for _, a := range images {
+		name, ok := wp.asset(id, a.AttachmentUrl)
+		if !ok {
+			wp.warnf(item, "gallery image %q isn't in the uploads directory, skipped", a.AttachmentUrl)
+			continue
+		}
+		fmt.Fprintf(&buf, "![%s](%s)\n\n", markdownText(html.UnescapeString(a.Title)), name)
+	}
+	return buf.String()
+}
+
+// An <img> tag, possibly wrapped in a link.
+var wpImage = regexp.MustCompile(`(?i)(<a\s[^>]*>\s*)?<img\s([^>]*?)/?>(\s*</a>)?`)
+
+// Images from the uploads directory turn into markdown images of files in
+// the post's asset directory. Links around them to the full size image go,
+// since findImage links to that itself.
+func (wp *wpImport) convertImages(item *wxrItem, id, content string) string {
+	return wpImage.ReplaceAllStringFunc(content, func(m string) string {
+		sub := wpImage.FindStringSubmatch(m)
+		img := parseAttrs(sub[2])
+		name, ok := wp.asset(id, html.UnescapeString(img["src"]))
+		if !ok {
+			return m
+		}
+
+		md := fmt.Sprintf("![%s](%s", markdownText(html.UnescapeString(img["alt"])), name)
+		if title := html.UnescapeString(img["title"]); title != "" {
+			md += fmt.Sprintf(" %q", title)
+		}
+		md += ")"
+
+		if sub[1] == "" {
+			return wp.keep(md, m)
+		}
+		link := strings.TrimSpace(sub[1])
+		href := html.UnescapeString(parseAttrs(link[len("<a") : len(link)-1])["href"])
+		if _, isUpload := wp.uploadUrl(href); isUpload {
+			return wp.keep(md, m)
+		}
+		return sub[1] + wp.keep(md, m[len(sub[1]):len(m)-len(sub[3])]) + sub[3]
+	})
+}
+
+// Escapes text for use in the alt text of a markdown image.
+func markdownText(text string) string {
+	return strings.NewReplacer("[", "\\[", "]", "\\]").Replace(strings.Join(strings.Fields(text), " "))
+}
+
+// WP makes downscaled copies of uploaded images as "name-300x200.png".
+var wpResized = regexp.MustCompile(`-\d+x\d+(\.[a-zA-Z0-9]+)$`)
+
+// If src is in the uploads directory of the old site, returns the URL of
+// the full size original.
+func (wp *wpImport) uploadUrl(src string) (string, bool) {
+	rest := stripScheme(src)
+	switch {
+	case strings.HasPrefix(rest, wp.uploads):
+	case strings.HasPrefix(src, "/wp-content/uploads/"):
+		rest = strings.TrimPrefix(wp.uploads, "/") + strings.TrimPrefix(src, "/wp-content/uploads/")
+	default:
+		return "", false
+	}
+	if i := strings.IndexAny(rest, "?#"); i != -1 {
+		rest = rest[:i]
+	}
+	scheme := "http://"
+	if strings.HasPrefix(src, "https:") {
+		scheme = "https://"
+	}
+	return scheme + wpResized.ReplaceAllString(rest, "$1"), true
+}
+
+// Maps an uploaded image to a file in the post's asset directory, and
+// records where to fetch it from. Returns the file name to use in the post.
+func (wp *wpImport) asset(id, src string) (string, bool) {
+	full, ok := wp.uploadUrl(src)
+	if !ok {
+		return "", false
+	}
+	base, err := url.PathUnescape(path.Base(full))
+	if err != nil {
+		base = path.Base(full)
+	}
+
+	// Different uploads (from different months, say) can share a name.
+	name := base
+	for n := 2; ; n++ {
+		p := filepath.Join(wp.blog.PostDir, id, name)
+		if other, taken := wp.manifest[p]; !taken || other == full {
+			wp.manifest[p] = full
+			return name, true
+		}
+		name = fmt.Sprintf("%d-%s", n, base)
+	}
+}
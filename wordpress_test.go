@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestWpImport() *wpImport {
+	return &wpImport{
+		blog:        NewBlog(),
+		base:        "example.com",
+		uploads:     "example.com/wp-content/uploads/",
+		attachments: map[string][]*wxrItem{},
+		byId:        map[string]*wxrItem{},
+		manifest:    map[string]string{},
+	}
+}
+
+func TestWpEscapeText(t *testing.T) {
+	tests := []struct {
+		para, want string
+	}{
+		{"plain text", "plain text"},
+		{"snake_case and *stars* [x]", `snake\_case and \*stars\* \[x\]`},
+		{"$5 or `cmd` {a} \\", "\\$5 or \\`cmd\\` \\{a\\} \\\\"},
+		{`<a href="/x_y">a_b</a>`, `<a href="/x_y">a\_b</a>`},
+		{"# not a heading\n> not a quote\n- not a list\n1. nor this", "\\# not a heading<br>\n\\> not a quote<br>\n\\- not a list<br>\n1\\. nor this"},
+		{"in 1999. we - said #1", "in 1999. we - said #1"},
+		{"one<br />\ntwo\nthree", "one<br />\ntwo<br>\nthree"},
+	}
+	for _, test := range tests {
+		if got := wpEscapeText(test.para); got != test.want {
+			t.Errorf("%q:\n got %q\nwant %q", test.para, got, test.want)
+		}
+	}
+}
+
+func TestWpConvertContent(t *testing.T) {
+	tests := []struct {
+		content, want string
+	}{
+		// wpautop paragraphs and line breaks
+		{"One\r\ntwo\r\n\r\n\r\nThree", "One<br>\ntwo\n\nThree"},
+		{"A <em>b_c</em>\n\n<h2>Title_1</h2>\n\nD", "A <em>b\\_c</em>\n\n<h2>Title_1</h2>\n\nD"},
+
+		// HTML blocks spanning paragraphs get <p> tags inside.
+		{"<blockquote>One\n\nTwo</blockquote>", "<blockquote><p>One</p>\n<p>Two</p></blockquote>"},
+
+		// Preformatted blocks stay as they are.
+		{"<pre>a_b\n\n*c*</pre>", "<pre>a_b\n\n*c*</pre>"},
+
+		// Shortcodes
+		{"[sourcecode language=\"python\"]\nif a &lt; b:\n    pass\n[/sourcecode]", "```python\nif a < b:\n    pass\n```"},
+		{"Run:\n[bash]ls *.go[/bash]", "Run:\n\n```bash\nls *.go\n```"},
+		{"[[caption]] and [unknown thing]", "\\[caption\\] and \\[unknown thing\\]"},
+		{"[latex]\\frac{a}{b}[/latex]", "$$\\frac{a}{b}$$"},
+
+		// Inline math
+		{"Where $latex a_b^2&bg=ffffff&fg=000000&s=1$ is *it*.", "Where $a_b^2$ is \\*it\\*."},
+
+		// Images from the uploads directory
+		{`<img src="http://example.com/wp-content/uploads/2010/01/cat-300x200.jpg" alt="A [cat]" />`, "![A \\[cat\\]](cat.jpg)"},
+		{`<a href="http://example.com/wp-content/uploads/2010/01/cat.jpg"><img src="/wp-content/uploads/2010/01/cat-300x200.jpg" alt="" title="Puss" /></a>`, `![](cat.jpg "Puss")`},
+		{`<a href="http://elsewhere.com/"><img src="http://example.com/wp-content/uploads/dog.png" alt="" /></a>`, `<a href="http://elsewhere.com/">![](dog.png)</a>`},
+		{`<img src="http://elsewhere.com/dog.png" alt="" />`, `<img src="http://elsewhere.com/dog.png" alt="" />`},
+		{`[caption id="a" width="300"]<img src="http://example.com/wp-content/uploads/cat.jpg" alt="" /> My_cat[/caption]`,
+			"{% figure %}\n![](cat.jpg)\n{% figcaption %}My\\_cat{% endfigcaption %}\n{% endfigure %}"},
+
+		// Markdown doesn't work inside HTML blocks.
+		{`<div><img src="http://example.com/wp-content/uploads/cat.jpg" alt="" /></div>`, `<div><img src="http://example.com/wp-content/uploads/cat.jpg" alt="" /></div>`},
+	}
+	for _, test := range tests {
+		wp := newTestWpImport()
+		item := &wxrItem{PostId: "1", Title: "T"}
+		if got := wp.convertContent(item, "post", test.content); got != test.want {
+			t.Errorf("%q:\n got %q\nwant %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestWpImageAssets(t *testing.T) {
+	wp := newTestWpImport()
+	item := &wxrItem{PostId: "1", Title: "T"}
+	got := wp.convertContent(item, "post", `<img src="https://example.com/wp-content/uploads/2010/01/cat.jpg?w=300" alt="" />
+
+<img src="http://example.com/wp-content/uploads/2011/02/cat-150x150.jpg" alt="" />`)
+	if want := "![](cat.jpg)\n\n![](2-cat.jpg)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	dir := filepath.Join(wp.blog.PostDir, "post")
+	want := map[string]string{
+		filepath.Join(dir, "cat.jpg"):   "https://example.com/wp-content/uploads/2010/01/cat.jpg",
+		filepath.Join(dir, "2-cat.jpg"): "http://example.com/wp-content/uploads/2011/02/cat.jpg",
+	}
+	for p, u := range want {
+		if wp.manifest[p] != u {
+			t.Errorf("%s: fetched from %q, want %q", p, wp.manifest[p], u)
+		}
+	}
+	if len(wp.manifest) != len(want) {
+		t.Errorf("got manifest %v, want %v", wp.manifest, want)
+	}
+}